@@ -0,0 +1,156 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// A note holds the comments of a statement of a macro body or of
+// a macro call, to be attached to the statements it was transformed into.
+type note struct {
+	orig        ast.Stmt            // the original statement
+	first, last ast.Stmt            // the first and the last transformed statements
+	comments    []*ast.CommentGroup // the comments of orig
+	annotation  string              // a comment showing the macro call, if orig is one
+}
+
+// attachComments records the comments of the statement orig, if any,
+// for the statements stmts it was transformed into.
+func (v *visitor) attachComments(orig ast.Stmt, stmts []ast.Stmt) {
+	if comments := v.cmap[orig]; len(comments) > 0 && len(stmts) > 0 {
+		v.notes = append(v.notes, note{orig: orig, first: stmts[0], last: stmts[len(stmts)-1], comments: comments})
+	}
+}
+
+// annotate records a comment showing the macro call in orig, for the
+// statements stmts it expanded into, if opts.Annotate is set.
+func (v *visitor) annotate(orig ast.Stmt, call *ast.CallExpr, stmts []ast.Stmt) {
+	if !v.opts.Annotate || len(stmts) == 0 {
+		return
+	}
+	src := v.source(call)
+	if i := strings.IndexByte(src, '\n'); i >= 0 {
+		src = src[:i] + " ..."
+	}
+	v.notes = append(v.notes, note{orig: orig, first: stmts[0], last: stmts[len(stmts)-1], annotation: "// expanded: " + src})
+}
+
+// insertComments inserts the recorded comments of the macro bodies into
+// output, the formatted tree, and formats it again. The transformed
+// statements have no positions the comments could be placed by, so they
+// are found in the parsed output, like in locate, and the comments are
+// inserted as text before, after or at the end of their lines.
+func (v *visitor) insertComments(tree *ast.File, output []byte) ([]byte, error) {
+	if len(v.notes) == 0 {
+		return output, nil
+	}
+
+	fset := token.NewFileSet()
+	parsed, err := parser.ParseFile(fset, "", output, 0)
+	if err != nil {
+		return output, nil
+	}
+	before, after := nodes(tree), nodes(parsed)
+	if len(before) != len(after) {
+		return output, nil
+	}
+	index := make(map[ast.Node]int, len(before))
+	for i, node := range before {
+		index[node] = i
+	}
+
+	type insertion struct {
+		offset int
+		order  int // the order of the insertions at the same offset
+		text   string
+	}
+	var insertions []insertion
+	for k, n := range v.notes {
+		i, ok1 := index[n.first]
+		j, ok2 := index[n.last]
+		if !ok1 || !ok2 {
+			continue
+		}
+		start, end := fset.Position(after[i].Pos()), fset.Position(after[j].End())
+		lineStart := start.Offset - (start.Column - 1)
+		indent := string(output[lineStart:start.Offset])
+		lineEnd := len(output)
+		if k := bytes.IndexByte(output[end.Offset:], '\n'); k >= 0 {
+			lineEnd = end.Offset + k
+		}
+
+		if n.annotation != "" {
+			// The annotation goes below the comments of the call.
+			insertions = append(insertions, insertion{lineStart, -2*k + 1, indent + n.annotation + "\n"})
+		}
+		origEnd := v.fset.Position(n.orig.End())
+		for _, cg := range n.comments {
+			var text bytes.Buffer
+			switch {
+			case cg.End() <= n.orig.Pos():
+				// A comment above the statement.
+				for _, c := range cg.List {
+					text.WriteString(indent + c.Text + "\n")
+				}
+				// The notes of the nested expansions come first,
+				// but their comments go below the outer ones.
+				insertions = append(insertions, insertion{lineStart, -2 * k, text.String()})
+			case v.fset.Position(cg.Pos()).Line == origEnd.Line:
+				// A comment at the end of the line of the statement.
+				for _, c := range cg.List {
+					text.WriteString(" " + c.Text)
+				}
+				insertions = append(insertions, insertion{lineEnd, k, text.String()})
+			default:
+				// A comment below the statement.
+				for _, c := range cg.List {
+					text.WriteString("\n" + indent + c.Text)
+				}
+				insertions = append(insertions, insertion{lineEnd, k, text.String()})
+			}
+		}
+	}
+	sort.SliceStable(insertions, func(i, j int) bool {
+		if insertions[i].offset != insertions[j].offset {
+			return insertions[i].offset < insertions[j].offset
+		}
+		return insertions[i].order < insertions[j].order
+	})
+
+	var buf bytes.Buffer
+	last := 0
+	for _, ins := range insertions {
+		buf.Write(output[last:ins.offset])
+		buf.WriteString(ins.text)
+		last = ins.offset
+	}
+	buf.Write(output[last:])
+
+	// Format the result again, to align the comments.
+	parsed, err = parser.ParseFile(fset, "", buf.Bytes(), parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var res bytes.Buffer
+	if err := printerConfig(v.opts).Fprint(&res, fset, parsed); err != nil {
+		return nil, err
+	}
+	return res.Bytes(), nil
+}
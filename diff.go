@@ -0,0 +1,205 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const diffContext = 3 // number of context lines around each hunk
+
+// splitLines splits b into lines, keeping the trailing newlines.
+func splitLines(b []byte) []string {
+	var lines []string
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			lines = append(lines, string(b)+"\n\\ No newline at end of file\n")
+			break
+		}
+		lines = append(lines, string(b[:i+1]))
+		b = b[i+1:]
+	}
+	return lines
+}
+
+// diff returns a unified diff of old and new, or nil if they are equal.
+func diff(oldName string, old []byte, newName string, new []byte) []byte {
+	if bytes.Equal(old, new) {
+		return nil
+	}
+
+	a, b := splitLines(old), splitLines(new)
+	edits := diffLines(a, b)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+
+	// Group the changes into hunks with some context around them.
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			// Look ahead for the next change within the context window.
+			n := end
+			for n < len(edits) && edits[n].op == ' ' && n-end < 2*diffContext {
+				n++
+			}
+			if n == len(edits) || edits[n].op == ' ' {
+				break
+			}
+			end = n
+		}
+		stop := end + diffContext
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+
+		var oldLen, newLen int
+		for _, e := range edits[start:stop] {
+			if e.op != '+' {
+				oldLen++
+			}
+			if e.op != '-' {
+				newLen++
+			}
+		}
+		oldStart, newStart := edits[start].i+1, edits[start].j+1
+		if oldLen == 0 {
+			oldStart--
+		}
+		if newLen == 0 {
+			newStart--
+		}
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", oldStart, oldLen, newStart, newLen)
+		for _, e := range edits[start:stop] {
+			buf.WriteByte(e.op)
+			buf.WriteString(e.line)
+		}
+
+		k = stop
+	}
+
+	return buf.Bytes()
+}
+
+// An edit keeps (' '), deletes ('-') or inserts ('+') a line.
+type edit struct {
+	op   byte
+	line string
+	i, j int // line indices in a and b before this edit
+}
+
+// diffLines returns the edit script turning the lines a into the lines b.
+// The lines common to the start and the end of a and b are kept, and the
+// rest is compared with Hirschberg's algorithm, in linear space.
+func diffLines(a, b []string) []edit {
+	var edits []edit
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		edits = append(edits, edit{' ', a[n], n, n})
+		n++
+	}
+	m := 0
+	for m < len(a)-n && m < len(b)-n && a[len(a)-1-m] == b[len(b)-1-m] {
+		m++
+	}
+	edits = hirschberg(edits, a[n:len(a)-m], b[n:len(b)-m], n, n)
+	for k := m; k > 0; k-- {
+		i, j := len(a)-k, len(b)-k
+		edits = append(edits, edit{' ', a[i], i, j})
+	}
+	return edits
+}
+
+// hirschberg appends to edits the edit script turning the lines a into
+// the lines b, which start at the lines i and j of the compared texts.
+func hirschberg(edits []edit, a, b []string, i, j int) []edit {
+	switch {
+	case len(a) == 0:
+		for k, line := range b {
+			edits = append(edits, edit{'+', line, i, j + k})
+		}
+		return edits
+	case len(b) == 0:
+		for k, line := range a {
+			edits = append(edits, edit{'-', line, i + k, j})
+		}
+		return edits
+	case len(a) == 1:
+		for k, line := range b {
+			if line == a[0] {
+				edits = hirschberg(edits, nil, b[:k], i, j)
+				edits = append(edits, edit{' ', line, i, j + k})
+				return hirschberg(edits, nil, b[k+1:], i+1, j+k+1)
+			}
+		}
+		edits = append(edits, edit{'-', a[0], i, j})
+		return hirschberg(edits, nil, b, i+1, j)
+	}
+
+	// Split b where the longest common subsequences of the halves
+	// of a with the two parts of b are the longest together.
+	mid := len(a) / 2
+	fwd := lcsLengths(a[:mid], b, false)
+	bwd := lcsLengths(a[mid:], b, true)
+	split := 0
+	for k := range fwd {
+		if fwd[k]+bwd[len(b)-k] > fwd[split]+bwd[len(b)-split] {
+			split = k
+		}
+	}
+	edits = hirschberg(edits, a[:mid], b[:split], i, j)
+	return hirschberg(edits, a[mid:], b[split:], i+mid, j+split)
+}
+
+// lcsLengths returns the lengths of the longest common subsequences of a
+// and the prefixes of b, indexed by their lengths, or of the suffixes of
+// a and b if reverse is set.
+func lcsLengths(a, b []string, reverse bool) []int {
+	at := func(lines []string, k int) string {
+		if reverse {
+			return lines[len(lines)-1-k]
+		}
+		return lines[k]
+	}
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case at(a, i) == at(b, j):
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] >= cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
@@ -0,0 +1,213 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An importRef is a package referenced in the body of a macro.
+type importRef struct {
+	name string // name the package is referred to by
+	path string // import path of the package
+}
+
+// packageName returns the default name of the package imported
+// from path: the last element of the path, without a version suffix
+// such as .v2.
+func packageName(importPath string) string {
+	name := path.Base(importPath)
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// fileImports returns the import paths of the packages
+// imported by file, indexed by the names they are referred to by.
+func fileImports(file *ast.File) map[string]string {
+	imports := make(map[string]string)
+	for _, spec := range file.Imports {
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		name := packageName(importPath)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		if name != "_" && name != "." {
+			imports[name] = importPath
+		}
+	}
+	return imports
+}
+
+// requiredImports returns the packages of imports referenced in
+// the body of the macro declared by decl, sorted by name.
+func requiredImports(decl *ast.FuncDecl, imports map[string]string) []importRef {
+	params := make(map[string]bool)
+	for _, field := range decl.Type.Params.List {
+		for _, name := range field.Names {
+			params[name.Name] = true
+		}
+	}
+
+	seen := make(map[string]bool)
+	var refs []importRef
+	ast.Inspect(decl.Body, func(node ast.Node) bool {
+		sel, ok := node.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); ok && !params[x.Name] && !seen[x.Name] {
+			if importPath, ok := imports[x.Name]; ok {
+				refs = append(refs, importRef{x.Name, importPath})
+				seen[x.Name] = true
+			}
+		}
+		return true
+	})
+	sort.Slice(refs, func(i, j int) bool { return refs[i].name < refs[j].name })
+	return refs
+}
+
+// addImports adds to tree the imports of the packages referenced
+// by the macros expanded in it, which it does not import yet.
+func (v *visitor) addImports(tree *ast.File) {
+	// The bodies of the conditionals not kept may refer to packages
+	// not used by the expansions: only consider the referenced names.
+	referenced := make(map[string]bool)
+	ast.Inspect(tree, func(node ast.Node) bool {
+		if sel, ok := node.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok {
+				referenced[x.Name] = true
+			}
+		}
+		return true
+	})
+
+	imported := fileImports(tree)
+	var missing []importRef
+	seen := make(map[string]bool)
+	for name := range v.used {
+		for _, ref := range v.imports[name] {
+			if !referenced[ref.name] {
+				continue
+			}
+			switch importPath, ok := imported[ref.name]; {
+			case !ok && !seen[ref.name]:
+				missing = append(missing, ref)
+				seen[ref.name] = true
+			case ok && importPath != ref.path:
+				v.errorf(tree.Package, "macro %q uses the package %q as %s, which refers to %q in this file",
+					name, ref.path, ref.name, importPath)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].path < missing[j].path })
+
+	// Add the imports to the first import declaration, or to a new one.
+	var decl *ast.GenDecl
+	if len(tree.Decls) > 0 {
+		if d, ok := tree.Decls[0].(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			decl = d
+		}
+	}
+	if decl == nil {
+		decl = &ast.GenDecl{Tok: token.IMPORT}
+		tree.Decls = append([]ast.Decl{decl}, tree.Decls...)
+	}
+	for _, ref := range missing {
+		spec := &ast.ImportSpec{Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(ref.path)}}
+		if ref.name != packageName(ref.path) {
+			spec.Name = ast.NewIdent(ref.name)
+		}
+		// Keep the imports sorted by path.
+		i := sort.Search(len(decl.Specs), func(i int) bool {
+			return decl.Specs[i].(*ast.ImportSpec).Path.Value > spec.Path.Value
+		})
+		decl.Specs = append(decl.Specs[:i], append([]ast.Spec{spec}, decl.Specs[i:]...)...)
+		tree.Imports = append(tree.Imports, spec)
+	}
+	if len(decl.Specs) > 1 && !decl.Lparen.IsValid() {
+		// Group the imports.
+		decl.Lparen = decl.TokPos
+		if !decl.Lparen.IsValid() {
+			decl.Lparen = tree.Package
+		}
+	}
+}
+
+// removeImports removes from tree the imports of the packages referenced
+// by the removed macro definitions, which the rest of tree does not use.
+func removeImports(tree *ast.File, removed []*ast.FuncDecl) {
+	imported := fileImports(tree)
+	unused := make(map[string]bool)
+	for _, decl := range removed {
+		for _, ref := range requiredImports(decl, imported) {
+			unused[ref.path] = true
+		}
+	}
+	if len(unused) == 0 {
+		return
+	}
+	ast.Inspect(tree, func(node ast.Node) bool {
+		if sel, ok := node.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok {
+				delete(unused, imported[x.Name])
+			}
+		}
+		return true
+	})
+	if len(unused) == 0 {
+		return
+	}
+
+	isUnused := func(spec *ast.ImportSpec) bool {
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		return err == nil && unused[importPath] && (spec.Name == nil || spec.Name.Name != "_" && spec.Name.Name != ".")
+	}
+	decls := tree.Decls[:0]
+	for _, decl := range tree.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			specs := gen.Specs[:0]
+			for _, spec := range gen.Specs {
+				if !isUnused(spec.(*ast.ImportSpec)) {
+					specs = append(specs, spec)
+				}
+			}
+			if gen.Specs = specs; len(specs) == 0 {
+				continue
+			}
+		}
+		decls = append(decls, decl)
+	}
+	tree.Decls = decls
+	imports := tree.Imports[:0]
+	for _, spec := range tree.Imports {
+		if !isUnused(spec) {
+			imports = append(imports, spec)
+		}
+	}
+	tree.Imports = imports
+}
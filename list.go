@@ -0,0 +1,67 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// A Macro describes a macro definition.
+type Macro struct {
+	Name      string         // name of the macro, qualified with its namespace, if any
+	Signature string         // parameters and results, e.g. "(a, b int) (int, int)"
+	Expr      bool           // whether the macro ends with a return statement yielding values
+	Pos       token.Position // position of the definition
+}
+
+// ListMacros parses the files filenames and returns
+// the macros defined in them, sorted by name.
+func ListMacros(filenames []string) ([]Macro, error) {
+	fset := token.NewFileSet()
+	v := newVisitor(fset, Options{})
+	var defs []*ast.FuncDecl
+	for _, filename := range filenames {
+		tree, err := parseTemplate(fset, filename, nil)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, v.collect(tree)...)
+	}
+	if v.errs.Len() > 0 {
+		v.errs.Sort()
+		return nil, v.errs
+	}
+
+	macros := make([]Macro, len(defs))
+	for i, def := range defs {
+		_, values := results(def.Body.List)
+		// Print the signature without the positions, on a single line.
+		sig := clone(&ast.FuncType{Params: def.Type.Params, Results: def.Type.Results}, func(token.Pos) token.Pos {
+			return token.NoPos
+		})
+		macros[i] = Macro{
+			Name:      macroName(def),
+			Signature: strings.TrimPrefix(v.source(sig.(*ast.FuncType)), "func"),
+			Expr:      len(values) > 0,
+			Pos:       fset.Position(def.Name.Pos()),
+		}
+	}
+	sort.Slice(macros, func(i, j int) bool {
+		return macros[i].Name < macros[j].Name
+	})
+	return macros, nil
+}
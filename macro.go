@@ -14,34 +14,145 @@
 package main
 
 import (
-	"flag"
+	"bytes"
 	"fmt"
 	"go/ast"
+	"go/constant"
 	"go/format"
 	"go/parser"
+	"go/printer"
+	"go/scanner"
 	"go/token"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 const prefix = "MACRO_"
 
-var recursive = flag.Bool("r", false, "Expand macros recursively")
+// Directives in the doc comments of the functions with the MACRO_ prefix.
+const (
+	ignoreDirective    = "//macro:ignore"     // the function is an ordinary one
+	keepDirective      = "//macro:keep"       // the definition is kept as an ordinary function, like with KeepDefs
+	namespaceDirective = "//macro:namespace " // the macro belongs to the namespace given after it
+)
+
+// maxDepth limits the nesting of recursive expansions.
+const maxDepth = 100
+
+// Names of the pseudo-functions recognized in macro bodies.
+// RAW is recognized in the arguments of the macro calls too,
+// and COND everywhere.
+const (
+	stringify = "STRINGIFY"
+	concat    = "CONCAT"
+	gensym    = "GENSYM"
+	ifdef     = "IFDEF"
+	ifndef    = "IFNDEF"
+	raw       = "RAW"
+	ternary   = "COND"
+	litConcat = "LIT_CONCAT"
+	fold      = "FOLD"
+)
+
+// Names of the pseudo-identifiers recognized in macro bodies, standing
+// for the name of the function the macro is called in, and the name of
+// the receiver of the method.
+const (
+	funcname = "FUNCNAME"
+	receiver = "RECEIVER"
+)
 
 type visitor struct {
-	macros       map[string]*ast.BlockStmt // macro definitions indexed by name
-	macroParams  map[string][]string       // lists of the names of the macros parameters
-	currentMacro string                    // the name of the macro we are currently expanding
-	replace      []ast.Expr                // parameters of the macro we are currently expanding
-	blocks       []*ast.BlockStmt          // a stack of nested code blocks
-	level        int                       // nesting level
-	lists        [][]ast.Stmt              // a stack of lists of expanded statements
+	fset         *token.FileSet              // positions of the parsed files
+	opts         Options                     // expansion options
+	errs         scanner.ErrorList           // errors found during the expansion
+	macros       map[string]*ast.BlockStmt   // macro definitions indexed by name
+	defs         map[*ast.FuncDecl]bool      // declarations of the macros
+	macroParams  map[string][]string         // lists of the names of the macros parameters
+	namespaces   map[string]bool             // namespaces of the macros declared with //macro:namespace
+	variadic     map[string]ast.Expr         // element types of the final ...T parameters of the variadic macros
+	outputs      map[string]*ast.FieldList   // named results of the macros, bound to the assigned variables
+	imports      map[string][]importRef      // packages referenced in the bodies of the macros
+	excluded     map[string]bool             // names of the macros left out by opts.Only, kept as functions
+	cmap         ast.CommentMap              // comments of the statements of the macro bodies
+	notes        []note                      // comments to attach to the expanded statements
+	packed       map[*ast.CompositeLit]bool  // slices of the variadic arguments packed for the current expansions
+	currentMacro string                      // the name of the macro we are currently expanding
+	replace      []ast.Expr                  // parameters of the macro we are currently expanding
+	hoisted      []ast.Stmt                  // statements to emit before the statement being transformed
+	declared     map[string]bool             // names declared so far in the current scope
+	params       map[*ast.BlockStmt][]string // names declared by the functions in the scopes of their bodies
+	gensyms      int                         // number of the identifiers generated so far
+	labels       map[string]*ast.Ident       // identifiers generated by GENSYM(label) in the current expansion
+	used         map[string]bool             // names of the macros that have been expanded at least once
+	depth        int                         // nesting depth of the current expansion
+	function     *ast.FuncDecl               // the function being walked
+	record       bool                        // whether to record the invocations
+	invocations  []*invocation               // the recorded invocations
+	expansions   []*Expansion                // the traced top-level expansions
+	tracing      []*Expansion                // a stack of the traced expansions in progress
+	stats        *Stats                      // the expansion statistics, if opts.Stats is set
+	dropped      [][2]int                    // first and last lines of the statements replaced with unpositioned code, and of the removed directives
+	callPos      token.Pos                   // position of the outermost macro call being expanded
+}
+
+// errorf records an error at the position pos.
+func (v *visitor) errorf(pos token.Pos, format string, args ...interface{}) {
+	v.errs.Add(v.fset.Position(pos), fmt.Sprintf(format, args...))
+}
+
+// warnf reports a warning at the position pos,
+// or records it as an error if opts.Werror is set.
+func (v *visitor) warnf(pos token.Pos, format string, args ...interface{}) {
+	if v.opts.Werror {
+		v.errorf(pos, format, args...)
+		return
+	}
+	if v.opts.Warnings != nil {
+		fmt.Fprintf(v.opts.Warnings, "%s: warning: %s\n", v.fset.Position(pos), fmt.Sprintf(format, args...))
+	}
+}
+
+// source returns the Go source text of expr.
+func (v *visitor) source(expr ast.Expr) string {
+	var buf bytes.Buffer
+	format.Node(&buf, v.fset, expr)
+	return buf.String()
+}
+
+// pos returns p, the position of a transformed node, if it is a node
+// of the code outside of the macros and opts.KeepPositions is set.
+// Otherwise, the node gets no position.
+func (v *visitor) pos(p token.Pos) token.Pos {
+	if v.opts.KeepPositions && v.currentMacro == "" {
+		return p
+	}
+	return token.NoPos
+}
+
+// keywordPos returns p, the position of the keyword starting a statement
+// or of a brace of a block, if it is in the code outside of the macros.
+// Such statements always keep them, so that the printer does not break
+// their lines before the arguments of the expanded calls, which have
+// their original positions.
+func (v *visitor) keywordPos(p token.Pos) token.Pos {
+	if v.currentMacro == "" {
+		return p
+	}
+	return token.NoPos
 }
 
 func (v *visitor) transformBasicLit(lit *ast.BasicLit) ast.Expr {
 	return &ast.BasicLit{
-		ValuePos: token.NoPos,
+		ValuePos: v.pos(lit.ValuePos),
 		Kind:     lit.Kind,
 		Value:    lit.Value,
 	}
@@ -50,22 +161,56 @@ func (v *visitor) transformBasicLit(lit *ast.BasicLit) ast.Expr {
 func (v *visitor) transformIdent(ident *ast.Ident) ast.Expr {
 	params := v.macroParams[v.currentMacro]
 	for i, param := range params {
-		if param == ident.Name {
+		// The blank identifier and the iota of the constant
+		// declarations are never substituted.
+		if param == ident.Name && ident.Name != "_" && ident.Name != "iota" {
 			return v.replace[i]
 		}
 	}
+	if i := len(params); len(v.replace) > i && ident.Name != "_" {
+		// The outputs are bound after the parameters.
+		for _, name := range fieldNames(v.outputs[v.currentMacro]) {
+			if name == ident.Name {
+				return v.replace[i]
+			}
+			i++
+		}
+	}
+	switch ident.Name {
+	case funcname:
+		if v.function == nil {
+			v.errorf(ident.Pos(), "%s used outside of a function", funcname)
+			break
+		}
+		return &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(v.function.Name.Name)}
+	case receiver:
+		if recv := v.function; recv == nil || recv.Recv == nil || len(recv.Recv.List[0].Names) == 0 {
+			v.errorf(ident.Pos(), "%s used outside of a method with a named receiver", receiver)
+			break
+		}
+		return ast.NewIdent(v.function.Recv.List[0].Names[0].Name)
+	}
 
 	return &ast.Ident{
-		NamePos: token.NoPos,
-		Name:    ident.Name,
+		NamePos: v.pos(ident.NamePos),
+		Name:    v.unprefixed(ident.Name),
 		Obj:     ident.Obj,
 	}
 }
 
+// unprefixed returns name without the MACRO_ prefix if it refers
+// to a macro left out by opts.Only, which is kept as a function.
+func (v *visitor) unprefixed(name string) string {
+	if unprefixed := strings.TrimPrefix(name, prefix); v.excluded[unprefixed] {
+		return unprefixed
+	}
+	return name
+}
+
 func (v *visitor) transformBinaryExpr(expr *ast.BinaryExpr) ast.Expr {
 	return &ast.BinaryExpr{
 		X:     v.transformExpr(expr.X),
-		OpPos: token.NoPos,
+		OpPos: v.pos(expr.OpPos),
 		Op:    expr.Op,
 		Y:     v.transformExpr(expr.Y),
 	}
@@ -74,50 +219,630 @@ func (v *visitor) transformBinaryExpr(expr *ast.BinaryExpr) ast.Expr {
 func (v *visitor) transformIndexExpr(expr *ast.IndexExpr) ast.Expr {
 	return &ast.IndexExpr{
 		X:      v.transformExpr(expr.X),
-		Lbrack: token.NoPos,
+		Lbrack: v.pos(expr.Lbrack),
 		Index:  v.transformExpr(expr.Index),
-		Rbrack: token.NoPos,
+		Rbrack: v.pos(expr.Rbrack),
+	}
+}
+
+func (v *visitor) transformIndexListExpr(expr *ast.IndexListExpr) ast.Expr {
+	indices := make([]ast.Expr, len(expr.Indices))
+	for i, index := range expr.Indices {
+		indices[i] = v.transformExpr(index)
+	}
+	return &ast.IndexListExpr{
+		X:       v.transformExpr(expr.X),
+		Lbrack:  v.pos(expr.Lbrack),
+		Indices: indices,
+		Rbrack:  v.pos(expr.Rbrack),
+	}
+}
+
+func (v *visitor) transformSliceExpr(expr *ast.SliceExpr) ast.Expr {
+	return &ast.SliceExpr{
+		X:      v.transformExpr(expr.X),
+		Lbrack: v.pos(expr.Lbrack),
+		Low:    v.transformExpr(expr.Low),
+		High:   v.transformExpr(expr.High),
+		Max:    v.transformExpr(expr.Max),
+		Slice3: expr.Slice3,
+		Rbrack: v.pos(expr.Rbrack),
+	}
+}
+
+func (v *visitor) transformTypeAssertExpr(expr *ast.TypeAssertExpr) ast.Expr {
+	return &ast.TypeAssertExpr{
+		X:      v.transformExpr(expr.X),
+		Lparen: v.pos(expr.Lparen),
+		Type:   v.transformExpr(expr.Type),
+		Rparen: v.pos(expr.Rparen),
+	}
+}
+
+func (v *visitor) transformEllipsis(expr *ast.Ellipsis) ast.Expr {
+	return &ast.Ellipsis{
+		Ellipsis: v.pos(expr.Ellipsis),
+		Elt:      v.transformExpr(expr.Elt),
 	}
 }
 
 func (v *visitor) transformUnaryExpr(expr *ast.UnaryExpr) ast.Expr {
 	return &ast.UnaryExpr{
-		OpPos: token.NoPos,
+		OpPos: v.pos(expr.OpPos),
 		Op:    expr.Op,
 		X:     v.transformExpr(expr.X),
 	}
 }
 
+// transformStringify expands STRINGIFY(x) into a string literal
+// holding the source text of x, with the parameters substituted.
+func (v *visitor) transformStringify(expr *ast.CallExpr) ast.Expr {
+	if len(expr.Args) != 1 {
+		v.errorf(expr.Pos(), "%s expects 1 argument, got %d", stringify, len(expr.Args))
+		return &ast.BasicLit{Kind: token.STRING, Value: `""`}
+	}
+	return &ast.BasicLit{
+		ValuePos: token.NoPos,
+		Kind:     token.STRING,
+		Value:    strconv.Quote(v.source(v.transformExpr(expr.Args[0]))),
+	}
+}
+
+// transformRaw expands RAW(x) into x, left as it is: neither
+// the parameters are substituted in it nor the macros are expanded.
+// In a macro body, the positions of x are dropped like the others.
+func (v *visitor) transformRaw(expr *ast.CallExpr) ast.Expr {
+	if len(expr.Args) != 1 {
+		v.errorf(expr.Pos(), "%s expects 1 argument, got %d", raw, len(expr.Args))
+		return expr
+	}
+	if v.currentMacro != "" {
+		return clone(expr.Args[0], v.pos).(ast.Expr)
+	}
+	return expr.Args[0]
+}
+
+// isPseudoCall reports whether expr is a call of the pseudo-function name.
+func isPseudoCall(expr ast.Expr, name string) bool {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	ident, ok := call.Fun.(*ast.Ident)
+	return ok && ident.Name == name
+}
+
+// transformTernary expands COND(c, a, b) used as a value into a call of
+// a function literal returning a if c holds, and b otherwise. The type
+// of the result is the optional fourth argument, or is inferred from a
+// or b if one of them is a literal or a parameter of the current macro.
+func (v *visitor) transformTernary(expr *ast.CallExpr) ast.Expr {
+	if len(expr.Args) < 3 || len(expr.Args) > 4 {
+		v.errorf(expr.Pos(), "%s expects 3 or 4 arguments, got %d", ternary, len(expr.Args))
+		return expr
+	}
+	args := v.transformArgs(expr.Args)
+	var typ ast.Expr
+	if len(args) == 4 {
+		typ = args[3]
+	} else {
+		for _, arg := range []ast.Expr{expr.Args[1], expr.Args[2], args[1], args[2]} {
+			if typ = v.typeOf(arg); typ != nil {
+				break
+			}
+		}
+	}
+	if typ == nil {
+		v.errorf(expr.Pos(), "%s: cannot infer the type of the result, pass it as the fourth argument", ternary)
+		return expr
+	}
+
+	return &ast.CallExpr{Fun: &ast.FuncLit{
+		Type: &ast.FuncType{
+			Params:  &ast.FieldList{},
+			Results: &ast.FieldList{List: []*ast.Field{{Type: typ}}},
+		},
+		Body: &ast.BlockStmt{List: []ast.Stmt{
+			&ast.IfStmt{
+				Cond: args[0],
+				Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ReturnStmt{Results: args[1:2]}}},
+			},
+			&ast.ReturnStmt{Results: args[2:3]},
+		}},
+	}}
+}
+
+// transformTernaryStmt expands COND(c, a, b) used as a statement into an
+// if statement evaluating a if c holds, and b otherwise.
+func (v *visitor) transformTernaryStmt(expr *ast.CallExpr) ast.Stmt {
+	if len(expr.Args) != 3 {
+		v.errorf(expr.Pos(), "%s expects 3 arguments in a statement, got %d", ternary, len(expr.Args))
+		return &ast.ExprStmt{X: expr}
+	}
+	args := v.transformArgs(expr.Args)
+	return &ast.IfStmt{
+		Cond: args[0],
+		Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ExprStmt{X: args[1]}}},
+		Else: &ast.BlockStmt{List: []ast.Stmt{&ast.ExprStmt{X: args[2]}}},
+	}
+}
+
+// typeOf returns the type of expr if it is evident from the syntax,
+// as for the literals and the parameters of the current macro, or nil.
+func (v *visitor) typeOf(expr ast.Expr) ast.Expr {
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		switch expr.Kind {
+		case token.INT:
+			return ast.NewIdent("int")
+		case token.FLOAT:
+			return ast.NewIdent("float64")
+		case token.IMAG:
+			return ast.NewIdent("complex128")
+		case token.CHAR:
+			return ast.NewIdent("rune")
+		case token.STRING:
+			return ast.NewIdent("string")
+		}
+	case *ast.Ident:
+		if expr.Name == "true" || expr.Name == "false" {
+			return ast.NewIdent("bool")
+		}
+		if decl := v.decl(v.currentMacro); decl != nil {
+			for _, field := range decl.Type.Params.List {
+				for _, name := range field.Names {
+					if _, ok := field.Type.(*ast.Ellipsis); !ok && name.Name == expr.Name {
+						return v.transformExpr(field.Type)
+					}
+				}
+			}
+		}
+	case *ast.CompositeLit:
+		return expr.Type
+	case *ast.FuncLit:
+		return expr.Type
+	case *ast.ParenExpr:
+		return v.typeOf(expr.X)
+	case *ast.UnaryExpr:
+		switch expr.Op {
+		case token.NOT:
+			return ast.NewIdent("bool")
+		case token.AND:
+			if typ := v.typeOf(expr.X); typ != nil {
+				return &ast.StarExpr{X: typ}
+			}
+		case token.SUB, token.ADD, token.XOR:
+			return v.typeOf(expr.X)
+		}
+	case *ast.BinaryExpr:
+		switch expr.Op {
+		case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ, token.LAND, token.LOR:
+			return ast.NewIdent("bool")
+		case token.SHL, token.SHR:
+			return v.typeOf(expr.X)
+		}
+		if typ := v.typeOf(expr.X); typ != nil {
+			return typ
+		}
+		return v.typeOf(expr.Y)
+	}
+	return nil
+}
+
+// transformConcat expands CONCAT(a, b, ...) into an identifier whose name
+// is the concatenation of the arguments, with the parameters substituted.
+// The arguments must be identifiers or integer literals.
+func (v *visitor) transformConcat(expr *ast.CallExpr) ast.Expr {
+	var name strings.Builder
+	for _, arg := range expr.Args {
+		switch arg := v.transformExpr(arg).(type) {
+		case *ast.Ident:
+			name.WriteString(arg.Name)
+		case *ast.BasicLit:
+			if arg.Kind == token.INT {
+				name.WriteString(arg.Value)
+				break
+			}
+			v.errorf(expr.Pos(), "%s: cannot concatenate %s", concat, arg.Value)
+		default:
+			v.errorf(expr.Pos(), "%s: cannot concatenate %s", concat, v.source(arg))
+		}
+	}
+
+	if !token.IsIdentifier(name.String()) {
+		v.errorf(expr.Pos(), "%s: %q is not a valid identifier", concat, name.String())
+	}
+
+	return &ast.Ident{
+		NamePos: token.NoPos,
+		Name:    name.String(),
+	}
+}
+
+// transformLitConcat expands LIT_CONCAT(a, b, ...) into a string literal
+// holding the concatenation of the arguments, with the parameters
+// substituted. The arguments must be string or integer literals.
+func (v *visitor) transformLitConcat(expr *ast.CallExpr) ast.Expr {
+	var value strings.Builder
+	for _, arg := range expr.Args {
+		lit, ok := v.transformExpr(arg).(*ast.BasicLit)
+		switch {
+		case ok && lit.Kind == token.STRING:
+			s, _ := strconv.Unquote(lit.Value)
+			value.WriteString(s)
+		case ok && lit.Kind == token.INT:
+			value.WriteString(constant.MakeFromLiteral(lit.Value, lit.Kind, 0).ExactString())
+		default:
+			v.errorf(arg.Pos(), "%s: %s is not a string or integer literal", litConcat, v.source(v.transformExpr(arg)))
+		}
+	}
+	return &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(value.String())}
+}
+
+// transformFold expands FOLD(x) into the value of the constant expression
+// x, with the parameters substituted, folded into a single literal. The
+// operands of x must be literals.
+func (v *visitor) transformFold(expr *ast.CallExpr) ast.Expr {
+	if len(expr.Args) != 1 {
+		v.errorf(expr.Pos(), "%s expects 1 argument, got %d", fold, len(expr.Args))
+		return expr
+	}
+	x := v.transformExpr(expr.Args[0])
+	val, ok := v.constValue(expr, x)
+	if !ok {
+		return expr
+	}
+	switch val.Kind() {
+	case constant.Bool:
+		return ast.NewIdent(val.String())
+	case constant.String:
+		return &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(constant.StringVal(val))}
+	case constant.Int:
+		return &ast.BasicLit{Kind: token.INT, Value: val.ExactString()}
+	case constant.Float:
+		f, _ := constant.Float64Val(val)
+		lit := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(lit, ".e") {
+			lit += ".0"
+		}
+		return &ast.BasicLit{Kind: token.FLOAT, Value: lit}
+	}
+	v.errorf(expr.Pos(), "%s: cannot fold %s", fold, v.source(x))
+	return expr
+}
+
+// constValue returns the value of the constant expression expr,
+// whose operands must be literals, or reports an error at call.
+func (v *visitor) constValue(call *ast.CallExpr, expr ast.Expr) (constant.Value, bool) {
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		if val := constant.MakeFromLiteral(expr.Value, expr.Kind, 0); val.Kind() != constant.Unknown {
+			return val, true
+		}
+	case *ast.Ident:
+		if expr.Name == "true" || expr.Name == "false" {
+			return constant.MakeBool(expr.Name == "true"), true
+		}
+	case *ast.ParenExpr:
+		return v.constValue(call, expr.X)
+	case *ast.UnaryExpr:
+		x, ok := v.constValue(call, expr.X)
+		if !ok {
+			return nil, false
+		}
+		switch expr.Op {
+		case token.ADD, token.SUB, token.XOR, token.NOT:
+			if val := constant.UnaryOp(expr.Op, x, 0); val.Kind() != constant.Unknown {
+				return val, true
+			}
+		}
+	case *ast.BinaryExpr:
+		x, ok1 := v.constValue(call, expr.X)
+		y, ok2 := v.constValue(call, expr.Y)
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		return v.binaryOp(call, expr, x, y)
+	}
+	v.errorf(call.Pos(), "%s: %s is not a constant expression of literals", fold, v.source(expr))
+	return nil, false
+}
+
+// binaryOp returns the value of the binary expression expr
+// with the constant operands x and y, or reports an error at call.
+func (v *visitor) binaryOp(call *ast.CallExpr, expr *ast.BinaryExpr, x, y constant.Value) (val constant.Value, ok bool) {
+	defer func() {
+		// The constant package panics on invalid operands.
+		if recover() != nil {
+			v.errorf(call.Pos(), "%s: invalid operation %s", fold, v.source(expr))
+			val, ok = nil, false
+		}
+	}()
+
+	switch op := expr.Op; op {
+	case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+		return constant.MakeBool(constant.Compare(x, op, y)), true
+	case token.SHL, token.SHR:
+		s, exact := constant.Uint64Val(y)
+		if !exact {
+			panic("invalid shift count")
+		}
+		return constant.Shift(x, op, uint(s)), true
+	case token.QUO, token.REM:
+		if constant.Sign(y) == 0 {
+			panic("division by zero")
+		}
+		if op == token.QUO && x.Kind() == constant.Int && y.Kind() == constant.Int {
+			// The integer division.
+			op = token.QUO_ASSIGN
+		}
+		return constant.BinaryOp(x, op, y), true
+	default:
+		val := constant.BinaryOp(x, op, y)
+		return val, val.Kind() != constant.Unknown
+	}
+}
+
+// transformGensym expands GENSYM() into a fresh identifier. All the
+// GENSYM(label) calls with the same label within a single expansion
+// yield the same identifier.
+func (v *visitor) transformGensym(expr *ast.CallExpr) ast.Expr {
+	var label string
+	switch len(expr.Args) {
+	case 0:
+	case 1:
+		ident, ok := expr.Args[0].(*ast.Ident)
+		if !ok {
+			v.errorf(expr.Pos(), "%s: label must be an identifier", gensym)
+			break
+		}
+		label = ident.Name
+		if sym, ok := v.labels[label]; ok {
+			return sym
+		}
+	default:
+		v.errorf(expr.Pos(), "%s expects at most 1 argument, got %d", gensym, len(expr.Args))
+	}
+
+	sym := v.newSym()
+	if label != "" {
+		v.labels[label] = sym
+	}
+	return sym
+}
+
+// newSym returns a fresh identifier.
+func (v *visitor) newSym() *ast.Ident {
+	sym := &ast.Ident{
+		NamePos: token.NoPos,
+		Name:    fmt.Sprintf("_gen_%d", v.gensyms),
+	}
+	v.gensyms++
+	return sym
+}
+
 func (v *visitor) transformCallExpr(expr *ast.CallExpr) ast.Expr {
+	if name, args, ok := v.callee(expr); ok && (v.currentMacro == "" || v.opts.Recursive) {
+		return v.expandValue(expr, name, v.transformArgs(args))
+	}
+	if ident, ok := expr.Fun.(*ast.Ident); ok {
+		switch ident.Name {
+		case stringify:
+			return v.transformStringify(expr)
+		case concat:
+			return v.transformConcat(expr)
+		case gensym:
+			return v.transformGensym(expr)
+		case raw:
+			return v.transformRaw(expr)
+		case ternary:
+			return v.transformTernary(expr)
+		case litConcat:
+			return v.transformLitConcat(expr)
+		case fold:
+			return v.transformFold(expr)
+		}
+	}
+
 	args := make([]ast.Expr, len(expr.Args))
 	for i := 0; i < len(args); i++ {
 		args[i] = v.transformExpr(expr.Args[i])
 	}
+	ellipsis := token.NoPos
+	if expr.Ellipsis.IsValid() {
+		if lit, ok := args[len(args)-1].(*ast.CompositeLit); ok && v.packed[lit] {
+			// Pass the packed variadic arguments as they were.
+			args = append(args[:len(args)-1], lit.Elts...)
+		} else {
+			// Keep the ... of the spread argument, next to it
+			// if it comes from the call site of the macro.
+			// The printer omits the ... at no position: use the one
+			// of the call of the macro, at the line of the expansion.
+			ellipsis = v.pos(expr.Ellipsis)
+			if !ellipsis.IsValid() {
+				ellipsis = v.callPos
+			}
+			if last := args[len(args)-1]; last.Pos().IsValid() && last.End() > last.Pos() {
+				ellipsis = last.End()
+			}
+		}
+	}
 	return &ast.CallExpr{
 		Fun:      v.transformExpr(expr.Fun),
-		Lparen:   token.NoPos,
+		Lparen:   v.pos(expr.Lparen),
 		Args:     args,
-		Ellipsis: token.NoPos,
-		Rparen:   token.NoPos,
+		Ellipsis: ellipsis,
+		Rparen:   v.pos(expr.Rparen),
 	}
 }
 
 func (v *visitor) transformParenExpr(expr *ast.ParenExpr) ast.Expr {
 	return &ast.ParenExpr{
-		Lparen: token.NoPos,
+		Lparen: v.pos(expr.Lparen),
 		X:      v.transformExpr(expr.X),
-		Rparen: token.NoPos,
+		Rparen: v.pos(expr.Rparen),
 	}
 }
 
+// transformName transforms an identifier in a position where only
+// a name is allowed, such as a selector or a declared name; what is
+// the name used for is described by what.
+func (v *visitor) transformName(ident *ast.Ident, what string) *ast.Ident {
+	repl := v.transformIdent(ident)
+	name, ok := repl.(*ast.Ident)
+	if !ok {
+		v.errorf(ident.Pos(), "cannot use %s as %s", v.source(repl), what)
+		return ident
+	}
+	return name
+}
+
 func (v *visitor) transformSelectorExpr(expr *ast.SelectorExpr) ast.Expr {
 	return &ast.SelectorExpr{
 		X:   v.transformExpr(expr.X),
-		Sel: v.transformIdent(expr.Sel).(*ast.Ident),
+		Sel: v.transformName(expr.Sel, "a selector"),
+	}
+}
+
+func (v *visitor) transformStarExpr(expr *ast.StarExpr) ast.Expr {
+	return &ast.StarExpr{
+		Star: v.pos(expr.Star),
+		X:    v.transformExpr(expr.X),
+	}
+}
+
+func (v *visitor) transformFuncLit(expr *ast.FuncLit) ast.Expr {
+	return &ast.FuncLit{
+		Type: v.transformFuncType(expr.Type),
+		Body: v.transformBlockStmt(expr.Body),
+	}
+}
+
+func (v *visitor) transformCompositeLit(lit *ast.CompositeLit) ast.Expr {
+	elts := make([]ast.Expr, len(lit.Elts))
+	for i, elt := range lit.Elts {
+		elts[i] = v.transformExpr(elt)
+	}
+	return &ast.CompositeLit{
+		Type:   v.transformExpr(lit.Type),
+		Lbrace: v.pos(lit.Lbrace),
+		Elts:   elts,
+		Rbrace: v.pos(lit.Rbrace),
+	}
+}
+
+func (v *visitor) transformKeyValueExpr(expr *ast.KeyValueExpr) ast.Expr {
+	return &ast.KeyValueExpr{
+		Key:   v.transformExpr(expr.Key),
+		Colon: v.pos(expr.Colon),
+		Value: v.transformExpr(expr.Value),
+	}
+}
+
+func (v *visitor) transformArrayType(expr *ast.ArrayType) ast.Expr {
+	return &ast.ArrayType{
+		Lbrack: v.pos(expr.Lbrack),
+		Len:    v.transformExpr(expr.Len),
+		Elt:    v.transformExpr(expr.Elt),
+	}
+}
+
+func (v *visitor) transformMapType(expr *ast.MapType) ast.Expr {
+	return &ast.MapType{
+		Map:   v.pos(expr.Map),
+		Key:   v.transformExpr(expr.Key),
+		Value: v.transformExpr(expr.Value),
+	}
+}
+
+func (v *visitor) transformChanType(expr *ast.ChanType) ast.Expr {
+	return &ast.ChanType{
+		Begin: v.pos(expr.Begin),
+		Arrow: v.pos(expr.Arrow),
+		Dir:   expr.Dir,
+		Value: v.transformExpr(expr.Value),
+	}
+}
+
+// transformFieldList transforms the fields of a struct, the methods of
+// an interface, or the parameters or results of a function type; what
+// describes the names of the fields.
+func (v *visitor) transformFieldList(list *ast.FieldList, what string) *ast.FieldList {
+	if list == nil {
+		return nil
+	}
+	fields := make([]*ast.Field, len(list.List))
+	for i, field := range list.List {
+		var names []*ast.Ident
+		for _, name := range field.Names {
+			names = append(names, v.transformName(name, what))
+		}
+		var tag *ast.BasicLit
+		if field.Tag != nil {
+			tag = v.transformBasicLit(field.Tag).(*ast.BasicLit)
+		}
+		fields[i] = &ast.Field{
+			Names: names,
+			Type:  v.transformExpr(field.Type),
+			Tag:   tag,
+		}
+	}
+	return &ast.FieldList{
+		Opening: v.pos(list.Opening),
+		List:    fields,
+		Closing: v.pos(list.Closing),
+	}
+}
+
+func (v *visitor) transformStructType(expr *ast.StructType) ast.Expr {
+	return &ast.StructType{
+		Struct: v.pos(expr.Struct),
+		Fields: v.transformFieldList(expr.Fields, "a field name"),
+	}
+}
+
+func (v *visitor) transformInterfaceType(expr *ast.InterfaceType) ast.Expr {
+	return &ast.InterfaceType{
+		Interface: v.pos(expr.Interface),
+		Methods:   v.transformFieldList(expr.Methods, "a method name"),
 	}
 }
 
+func (v *visitor) transformFuncType(expr *ast.FuncType) *ast.FuncType {
+	return &ast.FuncType{
+		Func:    v.pos(expr.Func),
+		Params:  v.transformFieldList(expr.Params, "a parameter name"),
+		Results: v.transformFieldList(expr.Results, "a result name"),
+	}
+}
+
+// transformCustom calls the custom transformers on node, and returns
+// the result of the first one that handles it.
+func (v *visitor) transformCustom(node ast.Node) (ast.Node, bool) {
+	for _, transform := range v.opts.Transformers {
+		if repl, ok := transform(node); ok {
+			return repl, true
+		}
+	}
+	return nil, false
+}
+
 func (v *visitor) transformExpr(expr ast.Expr) ast.Expr {
+	if expr == nil {
+		return nil
+	}
+	if repl, ok := v.transformCustom(expr); ok {
+		if repl, ok := repl.(ast.Expr); ok {
+			return repl
+		}
+		v.errorf(expr.Pos(), "transformer replaced the expression %s with %T", v.source(expr), repl)
+		return expr
+	}
+	if v.currentMacro == "" && !v.hasMacroCall(expr) {
+		// Keep the code outside of the macros as is.
+		return expr
+	}
+
 	switch expr := expr.(type) {
 	case *ast.Ident:
 		return v.transformIdent(expr)
@@ -127,6 +852,14 @@ func (v *visitor) transformExpr(expr ast.Expr) ast.Expr {
 		return v.transformBasicLit(expr)
 	case *ast.IndexExpr:
 		return v.transformIndexExpr(expr)
+	case *ast.IndexListExpr:
+		return v.transformIndexListExpr(expr)
+	case *ast.SliceExpr:
+		return v.transformSliceExpr(expr)
+	case *ast.TypeAssertExpr:
+		return v.transformTypeAssertExpr(expr)
+	case *ast.Ellipsis:
+		return v.transformEllipsis(expr)
 	case *ast.UnaryExpr:
 		return v.transformUnaryExpr(expr)
 	case *ast.CallExpr:
@@ -135,114 +868,1395 @@ func (v *visitor) transformExpr(expr ast.Expr) ast.Expr {
 		return v.transformParenExpr(expr)
 	case *ast.SelectorExpr:
 		return v.transformSelectorExpr(expr)
+	case *ast.CompositeLit:
+		return v.transformCompositeLit(expr)
+	case *ast.KeyValueExpr:
+		return v.transformKeyValueExpr(expr)
+	case *ast.StarExpr:
+		return v.transformStarExpr(expr)
+	case *ast.ArrayType:
+		return v.transformArrayType(expr)
+	case *ast.MapType:
+		return v.transformMapType(expr)
+	case *ast.ChanType:
+		return v.transformChanType(expr)
+	case *ast.StructType:
+		return v.transformStructType(expr)
+	case *ast.InterfaceType:
+		return v.transformInterfaceType(expr)
+	case *ast.FuncType:
+		return v.transformFuncType(expr)
+	case *ast.FuncLit:
+		return v.transformFuncLit(expr)
 	default:
-		panic(fmt.Sprintf("unexpected type: %T", expr))
+		v.errorf(expr.Pos(), "cannot expand the macros in %s (%T)", v.source(expr), expr)
+		return expr
+	}
+}
+
+// transformLhs transforms an expression assigned by a statement whose
+// token is tok. The variables declared by := must be identifiers.
+func (v *visitor) transformLhs(expr ast.Expr, tok token.Token) ast.Expr {
+	repl := v.transformExpr(expr)
+	if _, ok := repl.(*ast.Ident); !ok && repl != nil && tok == token.DEFINE {
+		v.errorf(expr.Pos(), "cannot use %s as a declared name", v.source(repl))
 	}
+	return repl
 }
 
 func (v *visitor) transformAssignStmt(stmt *ast.AssignStmt) ast.Stmt {
 	lhs := make([]ast.Expr, len(stmt.Lhs))
 	for i, expr := range stmt.Lhs {
-		lhs[i] = v.transformExpr(expr)
+		lhs[i] = v.transformLhs(expr, stmt.Tok)
 	}
 
 	rhs := make([]ast.Expr, len(stmt.Rhs))
-	for i, expr := range stmt.Rhs {
-		rhs[i] = v.transformExpr(expr)
+	if stmt.Tok == token.DEFINE {
+		rhs = v.transformDefinedValues(stmt.Rhs)
+	} else {
+		for i, expr := range stmt.Rhs {
+			rhs[i] = v.transformExpr(expr)
+		}
 	}
 
 	return &ast.AssignStmt{
 		Lhs:    lhs,
-		TokPos: token.NoPos,
+		TokPos: v.pos(stmt.TokPos),
 		Tok:    stmt.Tok,
 		Rhs:    rhs,
 	}
 }
 
+// transformExprStmt transforms an expression statement. The macro calls
+// in the statement lists are expanded before, so a macro call here is in
+// a single-statement context, such as the post statement of a for loop.
 func (v *visitor) transformExprStmt(stmt *ast.ExprStmt) ast.Stmt {
+	if call, ok := stmt.X.(*ast.CallExpr); ok {
+		if name, args, ok := v.callee(call); ok && (v.currentMacro == "" || v.opts.Recursive) {
+			errs := len(v.errs)
+			stmts := v.expand(call, name, v.transformArgs(args), nil)
+			switch {
+			case len(stmts) == 1:
+				return stmts[0]
+			case len(v.errs) == errs:
+				v.errorf(call.Pos(), "macro %q expands to %d statements and cannot be used as a single statement", name, len(stmts))
+			}
+			return stmt
+		}
+	}
+	if isPseudoCall(stmt.X, ternary) {
+		return v.transformTernaryStmt(stmt.X.(*ast.CallExpr))
+	}
 	return &ast.ExprStmt{X: v.transformExpr(stmt.X)}
 }
 
-func (v *visitor) expand(block *ast.BlockStmt) {
-	i := len(v.lists) - 1
-	v.lists[i] = make([]ast.Stmt, len(block.List))
-	for j, stmt := range block.List {
-		switch stmt := stmt.(type) {
-		case *ast.AssignStmt:
-			v.lists[i][j] = v.transformAssignStmt(stmt)
-		case *ast.ExprStmt:
-			v.lists[i][j] = v.transformExprStmt(stmt)
+func (v *visitor) transformValueSpec(spec *ast.ValueSpec) ast.Spec {
+	names := make([]*ast.Ident, len(spec.Names))
+	for i, name := range spec.Names {
+		names[i] = v.transformName(name, "a declared name")
+	}
+	var values []ast.Expr
+	for _, value := range spec.Values {
+		values = append(values, v.transformExpr(value))
+	}
+	return &ast.ValueSpec{
+		Names:  names,
+		Type:   v.transformExpr(spec.Type),
+		Values: values,
+	}
+}
+
+func (v *visitor) transformTypeSpec(spec *ast.TypeSpec) ast.Spec {
+	return &ast.TypeSpec{
+		Name:   v.transformName(spec.Name, "a declared name"),
+		Assign: spec.Assign,
+		Type:   v.transformExpr(spec.Type),
+	}
+}
+
+func (v *visitor) transformGenDecl(decl *ast.GenDecl) *ast.GenDecl {
+	specs := make([]ast.Spec, len(decl.Specs))
+	for i, spec := range decl.Specs {
+		switch spec := spec.(type) {
+		case *ast.ValueSpec:
+			specs[i] = v.transformValueSpec(spec)
+		case *ast.TypeSpec:
+			specs[i] = v.transformTypeSpec(spec)
 		default:
-			panic(fmt.Sprintf("unexpected type: %T", stmt))
+			panic(fmt.Sprintf("unexpected type: %T", spec))
+		}
+	}
+	lparen := token.NoPos
+	if decl.Lparen.IsValid() {
+		// Keep the declaration grouped, at the line of the call
+		// of the macro so that the printer stays in that line.
+		lparen = decl.Lparen
+		if v.currentMacro != "" {
+			lparen = v.callPos
 		}
 	}
+	return &ast.GenDecl{
+		TokPos: v.pos(decl.TokPos),
+		Tok:    decl.Tok,
+		Lparen: lparen,
+		Specs:  specs,
+		Rparen: v.pos(decl.Rparen),
+	}
 }
 
-func (v *visitor) processBlock(stmt *ast.BlockStmt) {
-	v.blocks = append(v.blocks, stmt)
-	// Increase nesting level.
-	v.level++
-	stmts := make([]ast.Stmt, 0)
+// transformGlobals expands the macro calls in the values of the package
+// level declaration decl. The declaration is modified in place, so that
+// its layout and comments are kept.
+func (v *visitor) transformGlobals(decl *ast.GenDecl) {
+	v.function = nil
+	for _, spec := range decl.Specs {
+		if spec, ok := spec.(*ast.ValueSpec); ok {
+			for i, value := range spec.Values {
+				spec.Values[i] = v.transformExpr(value)
+			}
+		}
+	}
+}
 
-	// Walk all the statements.
-	for _, stmt := range stmt.List {
-		v.lists = append(v.lists, nil)
+func (v *visitor) transformDeclStmt(stmt *ast.DeclStmt) ast.Stmt {
+	return &ast.DeclStmt{Decl: v.transformGenDecl(stmt.Decl.(*ast.GenDecl))}
+}
 
-		ast.Walk(v, stmt)
+func (v *visitor) transformEmptyStmt(stmt *ast.EmptyStmt) ast.Stmt {
+	return &ast.EmptyStmt{
+		Semicolon: v.pos(stmt.Semicolon),
+		Implicit:  stmt.Implicit,
+	}
+}
 
-		i := len(v.lists) - 1
-		if v.lists[i] == nil {
-			// No macro usages in this statement,
-			// keep the original statement.
-			stmts = append(stmts, stmt)
-		} else {
-			// Replace the statement with an expanded
-			// list of statements.
-			stmts = append(stmts, v.lists[i]...)
-		}
+func (v *visitor) transformBlockStmt(stmt *ast.BlockStmt) *ast.BlockStmt {
+	declared := v.declared
+	v.declared = make(map[string]bool)
+	defer func() { v.declared = declared }()
+	return &ast.BlockStmt{
+		Lbrace: v.keywordPos(stmt.Lbrace),
+		List:   v.transformStmtList(stmt.List),
+		Rbrace: v.keywordPos(stmt.Rbrace),
+	}
+}
 
-		v.lists = v.lists[:i]
+// transformInit transforms the init statement of an if, for or switch
+// statement. The statements a macro call in it expands to, except for the
+// final assignment of the results, are returned to be hoisted before the
+// enclosing statement with scoped.
+func (v *visitor) transformInit(stmt ast.Stmt) (init ast.Stmt, hoisted []ast.Stmt) {
+	if stmt == nil {
+		return nil, nil
 	}
+	// The init statement starts the scope of the enclosing statement.
+	saved, declared := v.hoisted, v.declared
+	v.hoisted, v.declared = nil, make(map[string]bool)
+	defer func() {
+		hoisted = v.hoisted
+		v.hoisted, v.declared = saved, declared
+	}()
 
-	// Decrease nesting level.
-	v.level--
-	// Replace the list of the block statements with a new (expanded) list.
-	v.blocks[v.level].List = stmts
-	v.blocks = v.blocks[:v.level]
+	if v.currentMacro != "" && !v.opts.Recursive {
+		return v.transformStmt(stmt), nil
+	}
+	if call, name, args, ok := v.macroCall(stmt); ok {
+		v.hoisted = append(v.hoisted, v.expand(call, name, v.transformArgs(args), nil)...)
+		return nil, nil
+	}
+	if assign, call, name, args, ok := v.assignCall(stmt); ok {
+		lhs := make([]ast.Expr, len(assign.Lhs))
+		for i, expr := range assign.Lhs {
+			lhs[i] = v.transformLhs(expr, assign.Tok)
+		}
+		stmts := v.expand(call, name, v.transformArgs(args), &ast.AssignStmt{Lhs: lhs, Tok: assign.Tok})
+		if len(stmts) == 0 {
+			return stmt, nil
+		}
+		if v.outputs[name] != nil {
+			// The results are assigned by the body.
+			v.hoisted = append(v.hoisted, stmts...)
+			return nil, nil
+		}
+		v.hoisted = append(v.hoisted, stmts[:len(stmts)-1]...)
+		return stmts[len(stmts)-1], nil
+	}
+	return v.transformStmt(stmt), nil
 }
 
-func (v *visitor) Visit(node ast.Node) ast.Visitor {
-	switch node := node.(type) {
-	case *ast.FuncDecl:
-		// A function declaration.
-		name := node.Name.Name
+// scoped returns stmt, preceded by the statements hoisted from its init
+// statement. If they declare names, they are put in a block with stmt,
+// so that the names do not leak out of the scope of stmt.
+func (v *visitor) scoped(hoisted []ast.Stmt, stmt ast.Stmt) ast.Stmt {
+	if len(declaredNames(hoisted)) == 0 {
+		v.hoisted = append(v.hoisted, hoisted...)
+		return stmt
+	}
+	return &ast.BlockStmt{List: append(hoisted, stmt)}
+}
 
-		// Check if it is a macro definition.
-		if !strings.HasPrefix(name, prefix) {
-			break
+func (v *visitor) transformIfStmt(stmt *ast.IfStmt) ast.Stmt {
+	init, hoisted := v.transformInit(stmt.Init)
+	var els ast.Stmt
+	if stmt.Else != nil {
+		hoisted := v.hoisted
+		v.hoisted = nil
+		els = v.transformStmt(stmt.Else)
+		if len(v.hoisted) > 0 {
+			// The hoisted statements of an else if must only
+			// be executed in the else branch.
+			els = &ast.BlockStmt{List: append(v.hoisted, els)}
 		}
+		v.hoisted = hoisted
+	}
+	return v.scoped(hoisted, &ast.IfStmt{
+		If:   v.keywordPos(stmt.If),
+		Init: init,
+		Cond: v.transformExpr(stmt.Cond),
+		Body: v.transformBlockStmt(stmt.Body),
+		Else: els,
+	})
+}
+
+func (v *visitor) transformForStmt(stmt *ast.ForStmt) ast.Stmt {
+	init, hoisted := v.transformInit(stmt.Init)
+	var post ast.Stmt
+	if stmt.Post != nil {
+		post = v.transformStmt(stmt.Post)
+	}
+	return v.scoped(hoisted, &ast.ForStmt{
+		For:  v.keywordPos(stmt.For),
+		Init: init,
+		Cond: v.transformExpr(stmt.Cond),
+		Post: post,
+		Body: v.transformBlockStmt(stmt.Body),
+	})
+}
+
+func (v *visitor) transformRangeStmt(stmt *ast.RangeStmt) ast.Stmt {
+	return &ast.RangeStmt{
+		For:    v.keywordPos(stmt.For),
+		Key:    v.transformLhs(stmt.Key, stmt.Tok),
+		Value:  v.transformLhs(stmt.Value, stmt.Tok),
+		TokPos: v.pos(stmt.TokPos),
+		Tok:    stmt.Tok,
+		X:      v.transformExpr(stmt.X),
+		Body:   v.transformBlockStmt(stmt.Body),
+	}
+}
+
+func (v *visitor) transformIncDecStmt(stmt *ast.IncDecStmt) ast.Stmt {
+	return &ast.IncDecStmt{
+		X:      v.transformExpr(stmt.X),
+		TokPos: v.pos(stmt.TokPos),
+		Tok:    stmt.Tok,
+	}
+}
+
+func (v *visitor) transformSendStmt(stmt *ast.SendStmt) ast.Stmt {
+	return &ast.SendStmt{
+		Chan:  v.transformExpr(stmt.Chan),
+		Arrow: v.pos(stmt.Arrow),
+		Value: v.transformExpr(stmt.Value),
+	}
+}
 
-		// Strip the MACRO_ prefix from the name.
-		name = strings.TrimPrefix(name, prefix)
+func (v *visitor) transformCommClause(clause *ast.CommClause) *ast.CommClause {
+	var comm ast.Stmt
+	if clause.Comm != nil {
+		comm = v.transformStmt(clause.Comm)
+	}
+	return &ast.CommClause{
+		Case:  v.keywordPos(clause.Case),
+		Comm:  comm,
+		Colon: v.pos(clause.Colon),
+		Body:  v.transformStmtList(clause.Body),
+	}
+}
+
+func (v *visitor) transformCaseClause(clause *ast.CaseClause) *ast.CaseClause {
+	var list []ast.Expr
+	for _, expr := range clause.List {
+		list = append(list, v.transformExpr(expr))
+	}
+	return &ast.CaseClause{
+		Case:  v.keywordPos(clause.Case),
+		List:  list,
+		Colon: v.pos(clause.Colon),
+		Body:  v.transformStmtList(clause.Body),
+	}
+}
 
-		if *recursive {
-			// Recursively expand macros.
-			v.processBlock(node.Body)
+// transformGuard transforms the tag of a switch statement, or the
+// expression of the guard of a type switch, described by what.
+// A macro called there must consist of a return statement.
+func (v *visitor) transformGuard(expr ast.Expr, what string) ast.Expr {
+	if call, ok := expr.(*ast.CallExpr); ok {
+		if name, _, ok := v.callee(call); ok && (v.currentMacro == "" || v.opts.Recursive) {
+			if body, _ := results(v.macros[name].List); len(body) > 0 {
+				v.errorf(call.Pos(), "macro %q expands to statements and cannot be used as %s", name, what)
+				return expr
+			}
 		}
+	}
+	return v.transformExpr(expr)
+}
+
+func (v *visitor) transformSwitchStmt(stmt *ast.SwitchStmt) ast.Stmt {
+	init, hoisted := v.transformInit(stmt.Init)
+	list := make([]ast.Stmt, len(stmt.Body.List))
+	for i, clause := range stmt.Body.List {
+		list[i] = v.transformCaseClause(clause.(*ast.CaseClause))
+	}
+	return v.scoped(hoisted, &ast.SwitchStmt{
+		Switch: v.keywordPos(stmt.Switch),
+		Init:   init,
+		Tag:    v.transformGuard(stmt.Tag, "a switch tag"),
+		Body:   &ast.BlockStmt{Lbrace: v.keywordPos(stmt.Body.Lbrace), List: list, Rbrace: v.keywordPos(stmt.Body.Rbrace)},
+	})
+}
 
-		// Save the macro body for later use.
-		v.macros[name] = node.Body
+func (v *visitor) transformTypeSwitchStmt(stmt *ast.TypeSwitchStmt) ast.Stmt {
+	init, hoisted := v.transformInit(stmt.Init)
 
-		// Save the macro params names.
-		var params []string
-		for _, p := range node.Type.Params.List {
-			for _, ident := range p.Names {
-				params = append(params, ident.Name)
+	// The guard is x.(type) or v := x.(type).
+	var assign ast.Stmt
+	guard := func(expr ast.Expr) ast.Expr {
+		x := expr.(*ast.TypeAssertExpr)
+		return &ast.TypeAssertExpr{
+			X:      v.transformGuard(x.X, "a type switch guard"),
+			Lparen: v.pos(x.Lparen),
+			Rparen: v.pos(x.Rparen),
+		}
+	}
+	switch s := stmt.Assign.(type) {
+	case *ast.AssignStmt:
+		assign = &ast.AssignStmt{
+			Lhs:    []ast.Expr{v.transformLhs(s.Lhs[0], s.Tok)},
+			TokPos: v.pos(s.TokPos),
+			Tok:    s.Tok,
+			Rhs:    []ast.Expr{guard(s.Rhs[0])},
+		}
+	case *ast.ExprStmt:
+		assign = &ast.ExprStmt{X: guard(s.X)}
+	}
+
+	list := make([]ast.Stmt, len(stmt.Body.List))
+	for i, clause := range stmt.Body.List {
+		list[i] = v.transformCaseClause(clause.(*ast.CaseClause))
+	}
+	return v.scoped(hoisted, &ast.TypeSwitchStmt{
+		Switch: v.keywordPos(stmt.Switch),
+		Init:   init,
+		Assign: assign,
+		Body:   &ast.BlockStmt{Lbrace: v.keywordPos(stmt.Body.Lbrace), List: list, Rbrace: v.keywordPos(stmt.Body.Rbrace)},
+	})
+}
+
+func (v *visitor) transformSelectStmt(stmt *ast.SelectStmt) ast.Stmt {
+	list := make([]ast.Stmt, len(stmt.Body.List))
+	for i, clause := range stmt.Body.List {
+		list[i] = v.transformCommClause(clause.(*ast.CommClause))
+	}
+	return &ast.SelectStmt{
+		Select: v.keywordPos(stmt.Select),
+		Body:   &ast.BlockStmt{Lbrace: v.keywordPos(stmt.Body.Lbrace), List: list, Rbrace: v.keywordPos(stmt.Body.Rbrace)},
+	}
+}
+
+// transformReturnStmt transforms a return statement. A macro called
+// as a result must consist of a return statement: a single macro call
+// yielding several values is replaced with them, like a function call.
+func (v *visitor) transformReturnStmt(stmt *ast.ReturnStmt) ast.Stmt {
+	var exprs []ast.Expr
+	for _, result := range stmt.Results {
+		if call, ok := result.(*ast.CallExpr); ok {
+			if name, args, ok := v.callee(call); ok && (v.currentMacro == "" || v.opts.Recursive) {
+				body, values := results(v.macros[name].List)
+				switch {
+				case len(body) > 0:
+					v.errorf(call.Pos(), "macro %q expands to statements and cannot be used in a return statement", name)
+					return stmt
+				case len(values) > 1 && len(stmt.Results) == 1:
+					return &ast.ReturnStmt{
+						Return:  v.keywordPos(stmt.Return),
+						Results: v.expandValues(call, name, v.transformArgs(args)),
+					}
+				}
 			}
 		}
-		v.macroParams[name] = params
+		exprs = append(exprs, v.transformExpr(result))
+	}
+	return &ast.ReturnStmt{
+		Return:  v.keywordPos(stmt.Return),
+		Results: exprs,
+	}
+}
+
+// transformDeferredCall transforms the call of a go or defer statement,
+// where tok is the keyword. A macro called there must expand to a call.
+func (v *visitor) transformDeferredCall(call *ast.CallExpr, tok token.Token) *ast.CallExpr {
+	if name, _, ok := v.callee(call); ok && (v.currentMacro == "" || v.opts.Recursive) {
+		if body, values := results(v.macros[name].List); len(body) > 0 || len(values) != 1 {
+			v.errorf(call.Pos(), "macro %q expands to statements and cannot be called with %s", name, tok)
+			return call
+		}
+	}
+	repl := v.transformExpr(call)
+	if repl, ok := repl.(*ast.CallExpr); ok {
+		return repl
+	}
+	if name, _, ok := v.callee(call); ok {
+		v.errorf(call.Pos(), "macro %q does not expand to a function call and cannot be called with %s", name, tok)
+	} else {
+		v.errorf(call.Pos(), "cannot call %s with %s", v.source(repl), tok)
+	}
+	return call
+}
 
-		return nil
+func (v *visitor) transformGoStmt(stmt *ast.GoStmt) ast.Stmt {
+	return &ast.GoStmt{
+		Go:   v.keywordPos(stmt.Go),
+		Call: v.transformDeferredCall(stmt.Call, token.GO),
+	}
+}
+
+func (v *visitor) transformDeferStmt(stmt *ast.DeferStmt) ast.Stmt {
+	return &ast.DeferStmt{
+		Defer: v.keywordPos(stmt.Defer),
+		Call:  v.transformDeferredCall(stmt.Call, token.DEFER),
+	}
+}
+
+func (v *visitor) transformLabeledStmt(stmt *ast.LabeledStmt) ast.Stmt {
+	labeled := &ast.LabeledStmt{
+		Label: v.transformName(stmt.Label, "a label"),
+		Colon: v.pos(stmt.Colon),
+		Stmt:  v.transformStmt(stmt.Stmt),
+	}
+	if block, ok := labeled.Stmt.(*ast.BlockStmt); ok {
+		if _, ok := stmt.Stmt.(*ast.BlockStmt); !ok {
+			// The statement is scoped with the statements hoisted from
+			// its init statement, keep the label on the statement.
+			last := len(block.List) - 1
+			labeled.Stmt, block.List[last] = block.List[last], labeled
+			return block
+		}
+	}
+	return labeled
+}
+
+func (v *visitor) transformBranchStmt(stmt *ast.BranchStmt) ast.Stmt {
+	var label *ast.Ident
+	if stmt.Label != nil {
+		label = v.transformName(stmt.Label, "a label")
+	}
+	return &ast.BranchStmt{
+		TokPos: v.pos(stmt.TokPos),
+		Tok:    stmt.Tok,
+		Label:  label,
+	}
+}
+
+// transformCustomStmt calls the custom transformers on stmt, and returns
+// the resulting statement if one of them handles it.
+func (v *visitor) transformCustomStmt(stmt ast.Stmt) (ast.Stmt, bool) {
+	repl, ok := v.transformCustom(stmt)
+	if !ok {
+		return nil, false
+	}
+	if repl, ok := repl.(ast.Stmt); ok {
+		return repl, true
+	}
+	v.errorf(stmt.Pos(), "transformer replaced a statement with %T", repl)
+	return stmt, true
+}
+
+func (v *visitor) transformStmt(stmt ast.Stmt) ast.Stmt {
+	if repl, ok := v.transformCustomStmt(stmt); ok {
+		return repl
+	}
+	if v.currentMacro == "" && !v.hasMacroCall(stmt) {
+		// Keep the code outside of the macros as is.
+		return stmt
+	}
+
+	switch stmt := stmt.(type) {
+	case *ast.AssignStmt:
+		return v.transformAssignStmt(stmt)
+	case *ast.ExprStmt:
+		return v.transformExprStmt(stmt)
+	case *ast.EmptyStmt:
+		return v.transformEmptyStmt(stmt)
+	case *ast.BlockStmt:
+		return v.transformBlockStmt(stmt)
+	case *ast.IfStmt:
+		return v.transformIfStmt(stmt)
+	case *ast.SwitchStmt:
+		return v.transformSwitchStmt(stmt)
+	case *ast.TypeSwitchStmt:
+		return v.transformTypeSwitchStmt(stmt)
+	case *ast.ForStmt:
+		return v.transformForStmt(stmt)
+	case *ast.RangeStmt:
+		return v.transformRangeStmt(stmt)
+	case *ast.IncDecStmt:
+		return v.transformIncDecStmt(stmt)
+	case *ast.DeclStmt:
+		return v.transformDeclStmt(stmt)
+	case *ast.SendStmt:
+		return v.transformSendStmt(stmt)
+	case *ast.SelectStmt:
+		return v.transformSelectStmt(stmt)
+	case *ast.ReturnStmt:
+		return v.transformReturnStmt(stmt)
+	case *ast.BranchStmt:
+		return v.transformBranchStmt(stmt)
+	case *ast.LabeledStmt:
+		return v.transformLabeledStmt(stmt)
+	case *ast.GoStmt:
+		return v.transformGoStmt(stmt)
+	case *ast.DeferStmt:
+		return v.transformDeferStmt(stmt)
+	default:
+		panic(fmt.Sprintf("unexpected type: %T", stmt))
+	}
+}
+
+// conditional reports whether stmt is an IFDEF(NAME) or IFNDEF(NAME)
+// conditional, and if so, whether its condition holds. IFDEF(NAME) holds
+// if the symbol NAME is defined, IFDEF(NAME, value) holds if it is
+// defined with the given value. IFNDEF is the negation of IFDEF.
+func (v *visitor) conditional(stmt ast.Stmt) (cond, ok bool) {
+	ifStmt, ok := stmt.(*ast.IfStmt)
+	if !ok || ifStmt.Init != nil {
+		return false, false
+	}
+	call, ok := ifStmt.Cond.(*ast.CallExpr)
+	if !ok {
+		return false, false
+	}
+	ident, ok := call.Fun.(*ast.Ident)
+	if !ok || ident.Name != ifdef && ident.Name != ifndef {
+		return false, false
+	}
+
+	if len(call.Args) < 1 || len(call.Args) > 2 {
+		v.errorf(call.Pos(), "%s expects 1 or 2 arguments, got %d", ident.Name, len(call.Args))
+		return false, true
+	}
+	sym, ok := call.Args[0].(*ast.Ident)
+	if !ok {
+		v.errorf(call.Args[0].Pos(), "%s: symbol must be an identifier", ident.Name)
+		return false, true
+	}
+	value, defined := v.opts.Defines[sym.Name]
+	if defined && len(call.Args) == 2 {
+		lit, ok := call.Args[1].(*ast.BasicLit)
+		if !ok {
+			v.errorf(call.Args[1].Pos(), "%s: value must be a literal", ident.Name)
+			return false, true
+		}
+		want := lit.Value
+		if lit.Kind == token.STRING {
+			want, _ = strconv.Unquote(lit.Value)
+		}
+		defined = value == want
+	}
+
+	return defined == (ident.Name == ifdef), true
+}
+
+// callee returns the name of the macro called by call and the arguments
+// of the call, if it is a macro call. A macro can be called as a function,
+// name(args...), or as a method, x.MACRO_name(args...), in which case x
+// is passed as the first argument.
+func (v *visitor) callee(call *ast.CallExpr) (string, []ast.Expr, bool) {
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		// The macros may be called with or without the MACRO_ prefix.
+		if name := strings.TrimPrefix(fun.Name, prefix); v.macros[name] != nil {
+			return name, call.Args, true
+		}
+	case *ast.SelectorExpr:
+		if x, ok := fun.X.(*ast.Ident); ok && v.namespaces[x.Name] {
+			// A macro of a namespace.
+			name := x.Name + "." + fun.Sel.Name
+			if _, ok := v.macros[name]; ok {
+				return name, call.Args, true
+			}
+		}
+		name := strings.TrimPrefix(fun.Sel.Name, prefix)
+		if _, ok := v.macros[name]; ok && name != fun.Sel.Name {
+			return name, append([]ast.Expr{fun.X}, call.Args...), true
+		}
+	}
+	return "", nil, false
+}
+
+// macroCall returns the call, the name of the macro and the arguments
+// if stmt is a statement-position macro call.
+func (v *visitor) macroCall(stmt ast.Stmt) (*ast.CallExpr, string, []ast.Expr, bool) {
+	expr, ok := stmt.(*ast.ExprStmt)
+	if !ok {
+		return nil, "", nil, false
+	}
+	call, ok := expr.X.(*ast.CallExpr)
+	if !ok {
+		return nil, "", nil, false
+	}
+	name, args, ok := v.callee(call)
+	return call, name, args, ok
+}
+
+// assignCall returns the assignment, the call, the name of the macro
+// and the arguments if stmt assigns the results of a macro call.
+func (v *visitor) assignCall(stmt ast.Stmt) (*ast.AssignStmt, *ast.CallExpr, string, []ast.Expr, bool) {
+	assign, ok := stmt.(*ast.AssignStmt)
+	if !ok || len(assign.Rhs) != 1 {
+		return nil, nil, "", nil, false
+	}
+	call, ok := assign.Rhs[0].(*ast.CallExpr)
+	if !ok {
+		return nil, nil, "", nil, false
+	}
+	name, args, ok := v.callee(call)
+	return assign, call, name, args, ok
+}
+
+// transformArgs transforms the arguments of a macro call: the parameters
+// of the current macro are substituted, and the macro calls are expanded,
+// before the arguments are bound to the parameters of the called macro.
+func (v *visitor) transformArgs(args []ast.Expr) []ast.Expr {
+	repl := make([]ast.Expr, len(args))
+	for i, arg := range args {
+		repl[i] = v.transformExpr(arg)
+	}
+	return repl
+}
+
+// transformStmtList transforms a list of statements of a macro body.
+// With -r, the statement-position macro calls are expanded in place.
+func (v *visitor) transformStmtList(list []ast.Stmt) []ast.Stmt {
+	stmts := make([]ast.Stmt, 0, len(list))
+	for _, stmt := range list {
+		v.declare(stmts...)
+		if cond, ok := v.conditional(stmt); ok {
+			// Keep either the body or the else branch of the conditional.
+			ifStmt := stmt.(*ast.IfStmt)
+			switch {
+			case cond:
+				stmts = append(stmts, v.transformStmtList(ifStmt.Body.List)...)
+			case ifStmt.Else != nil:
+				if block, ok := ifStmt.Else.(*ast.BlockStmt); ok {
+					stmts = append(stmts, v.transformStmtList(block.List)...)
+				} else {
+					stmts = append(stmts, v.transformStmtList([]ast.Stmt{ifStmt.Else})...)
+				}
+			}
+			continue
+		}
+		if call, name, args, ok := v.macroCall(stmt); ok && v.opts.Recursive {
+			expansion := v.expand(call, name, v.transformArgs(args), nil)
+			v.attachComments(stmt, expansion)
+			stmts = append(stmts, expansion...)
+			continue
+		}
+		if assign, call, name, args, ok := v.assignCall(stmt); ok && v.opts.Recursive {
+			lhs := make([]ast.Expr, len(assign.Lhs))
+			for i, expr := range assign.Lhs {
+				lhs[i] = v.transformLhs(expr, assign.Tok)
+			}
+			expansion := v.expand(call, name, v.transformArgs(args), &ast.AssignStmt{Lhs: lhs, Tok: assign.Tok})
+			v.attachComments(stmt, expansion)
+			stmts = append(stmts, expansion...)
+			continue
+		}
+		hoisted := v.hoisted
+		v.hoisted = nil
+		repl := v.transformStmt(stmt)
+		if v.currentMacro != "" {
+			v.attachComments(stmt, []ast.Stmt{repl})
+		}
+		stmts = append(append(stmts, v.hoisted...), repl)
+		v.hoisted = hoisted
+	}
+	return stmts
+}
+
+// instantiate checks the call of the macro name with the arguments args
+// and calls f with the body of the macro, while its parameters are bound
+// to the arguments. f returns the nodes the call expanded into.
+func (v *visitor) instantiate(call *ast.CallExpr, name string, args []ast.Expr, f func(body []ast.Stmt) []ast.Node) {
+	if v.depth == maxDepth {
+		v.errorf(call.Pos(), "macro %q: expansion is nested too deeply", name)
+		return
+	}
+	if fun, ok := call.Fun.(*ast.SelectorExpr); ok && len(v.macroParams[name]) == 0 {
+		v.errorf(fun.Sel.Pos(), "macro %q has no parameter for the receiver %s", name, v.source(fun.X))
+		return
+	}
+	n := len(v.macroParams[name])
+	elt, variadic := v.variadic[name]
+	switch {
+	case call.Ellipsis.IsValid() && !variadic:
+		v.errorf(call.Ellipsis, "cannot use ... in call to non-variadic macro %q", name)
+		return
+	case variadic && !call.Ellipsis.IsValid():
+		if len(args) < n-1 {
+			v.errorf(call.Pos(), "macro %q expects at least %d arguments, got %d", name, n-1, len(args))
+			return
+		}
+	case len(args) != n:
+		v.errorf(call.Pos(), "macro %q expects %d arguments, got %d", name, n, len(args))
+		return
+	}
+
+	// Save the state of the enclosing expansion, if any.
+	currentMacro, replace, labels := v.currentMacro, v.replace, v.labels
+	v.depth++
+	defer func() {
+		v.currentMacro, v.replace, v.labels = currentMacro, replace, labels
+		v.depth--
+	}()
+
+	if v.opts.Log != nil {
+		v.opts.Log.Printf("%s: expanding %s with %d arguments at depth %d",
+			v.fset.Position(call.Pos()), name, len(args), v.depth)
+	}
+
+	if v.currentMacro == "" {
+		v.callPos = call.Pos()
+	}
+	v.currentMacro = name
+	v.used[name] = true
+	if v.stats != nil {
+		v.stats.Expansions++
+		v.stats.Counts[name]++
+		if v.depth > v.stats.MaxDepth {
+			v.stats.MaxDepth = v.depth
+		}
+	}
+	v.labels = make(map[string]*ast.Ident)
+	// Prepare a list of parameter substitutions.
+	v.replace = args
+	if variadic && !call.Ellipsis.IsValid() {
+		// Pack the variadic arguments into a slice.
+		lit := &ast.CompositeLit{Type: &ast.ArrayType{Elt: elt}, Elts: args[n-1:]}
+		v.packed[lit] = true
+		defer delete(v.packed, lit)
+		v.replace = append(args[:n-1:n-1], lit)
+	}
+
+	if v.opts.Trace {
+		exp := &Expansion{Macro: name, Pos: v.fset.Position(call.Pos())}
+		for _, arg := range args {
+			exp.Args = append(exp.Args, v.source(arg))
+		}
+		if n := len(v.tracing); n > 0 {
+			v.tracing[n-1].Nested = append(v.tracing[n-1].Nested, exp)
+		} else {
+			v.expansions = append(v.expansions, exp)
+		}
+		v.tracing = append(v.tracing, exp)
+		defer func() { v.tracing = v.tracing[:len(v.tracing)-1] }()
+	}
+
+	var inv *invocation
+	if v.record {
+		inv = &invocation{call: call, name: name, args: args}
+		v.invocations = append(v.invocations, inv)
+	}
+
+	nodes := f(v.macros[name].List)
+	if inv != nil {
+		inv.nodes = nodes
+	}
+}
+
+// results splits off the final return statement of the macro body,
+// and returns the preceding statements and the returned expressions.
+func results(body []ast.Stmt) ([]ast.Stmt, []ast.Expr) {
+	if n := len(body); n > 0 {
+		if ret, ok := body[n-1].(*ast.ReturnStmt); ok {
+			return body[:n-1], ret.Results
+		}
+	}
+	return body, nil
+}
+
+// expand expands the call of the macro name with the arguments args
+// and returns the resulting list of statements.
+//
+// If assign is not nil, the call is the value of the assignment assign.
+// If the macro has named results, they are bound to the left-hand side
+// of assign, declared first if assign is a short variable declaration.
+// Otherwise, the final statement of the macro must be a return statement:
+// the preceding statements are expanded before the assignment, and the
+// returned expressions are assigned to the left-hand side of assign.
+func (v *visitor) expand(call *ast.CallExpr, name string, args []ast.Expr, assign *ast.AssignStmt) []ast.Stmt {
+	var stmts []ast.Stmt
+	v.instantiate(call, name, args, func(body []ast.Stmt) []ast.Node {
+		outputs := v.outputs[name]
+		switch {
+		case assign == nil:
+			stmts = v.transformStmtList(body)
+		case outputs != nil:
+			if n := len(fieldNames(outputs)); len(assign.Lhs) != n {
+				v.errorf(call.Pos(), "assignment mismatch: %d variables but macro %q has %d results", len(assign.Lhs), name, n)
+				return nil
+			}
+			v.replace = append(v.replace[:len(v.replace):len(v.replace)], assign.Lhs...)
+			if assign.Tok == token.DEFINE {
+				stmts = v.declareOutputs(outputs)
+			}
+			stmts = append(stmts, v.transformStmtList(body)...)
+		default:
+			body, values := results(body)
+			// A single value may be a call or a comma-ok
+			// expression assigned to several variables.
+			if len(values) == 0 || len(values) > 1 && len(values) != len(assign.Lhs) {
+				v.errorf(call.Pos(), "assignment mismatch: %d variables but macro %q yields %d values", len(assign.Lhs), name, len(values))
+				return nil
+			}
+			stmts = v.transformStmtList(body)
+			for _, expr := range values {
+				assign.Rhs = append(assign.Rhs, v.transformExpr(expr))
+			}
+			stmts = append(stmts, assign)
+		}
+
+		nodes := make([]ast.Node, len(stmts))
+		for i, stmt := range stmts {
+			nodes[i] = stmt
+		}
+		return nodes
+	})
+	return stmts
+}
+
+// declare records the names declared by stmts in the current scope.
+func (v *visitor) declare(stmts ...ast.Stmt) {
+	if v.declared == nil {
+		return
+	}
+	for _, name := range declaredNames(stmts) {
+		v.declared[name] = true
+	}
+}
+
+// declaredNames returns the names declared by stmts in their scope.
+func declaredNames(stmts []ast.Stmt) []string {
+	var names []string
+	for _, stmt := range stmts {
+		switch stmt := stmt.(type) {
+		case *ast.AssignStmt:
+			if stmt.Tok == token.DEFINE {
+				for _, expr := range stmt.Lhs {
+					if ident, ok := expr.(*ast.Ident); ok {
+						names = append(names, ident.Name)
+					}
+				}
+			}
+		case *ast.DeclStmt:
+			for _, spec := range stmt.Decl.(*ast.GenDecl).Specs {
+				switch spec := spec.(type) {
+				case *ast.ValueSpec:
+					for _, ident := range spec.Names {
+						names = append(names, ident.Name)
+					}
+				case *ast.TypeSpec:
+					names = append(names, spec.Name.Name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// declareOutputs declares the variables bound to the named results
+// of the macro being expanded.
+func (v *visitor) declareOutputs(outputs *ast.FieldList) []ast.Stmt {
+	var stmts []ast.Stmt
+	for _, field := range outputs.List {
+		var names []*ast.Ident
+		for _, name := range field.Names {
+			// := only declares the variables not declared yet in the scope.
+			if name := v.transformName(name, "a declared name"); name.Name != "_" && !v.declared[name.Name] {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		stmts = append(stmts, &ast.DeclStmt{Decl: &ast.GenDecl{
+			Tok:   token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{Names: names, Type: v.transformExpr(field.Type)}},
+		}})
+	}
+	return stmts
+}
+
+// expandValue expands the call of the macro name with the arguments args
+// used as a value. The macro must consist of a single return statement
+// with one result, which replaces the call.
+func (v *visitor) expandValue(call *ast.CallExpr, name string, args []ast.Expr) ast.Expr {
+	var value ast.Expr = call
+	v.instantiate(call, name, args, func(body []ast.Stmt) []ast.Node {
+		body, values := results(body)
+		switch {
+		case len(values) != 1:
+			v.errorf(call.Pos(), "macro %q yields %d values and cannot be used as a value", name, len(values))
+			return nil
+		case len(body) > 0:
+			v.errorf(call.Pos(), "macro %q expands to statements and cannot be used as a value", name)
+			return nil
+		}
+		value = v.transformExpr(values[0])
+		return []ast.Node{value}
+	})
+	return value
+}
+
+// transformDefinedValues transforms the values of a short variable
+// declaration. The macros declaring some of the variables may expand to
+// statements, hoisted before the declaration. If other values are to be
+// evaluated before the statements, these values are bound to temporaries
+// first, and the values of the macros expanding to statements, except the
+// last one, are computed in blocks of their own, so that the values are
+// evaluated in order and the names declared by the macros do not clash.
+func (v *visitor) transformDefinedValues(exprs []ast.Expr) []ast.Expr {
+	values := make([]ast.Expr, len(exprs))
+	stmts := make([][]ast.Stmt, len(exprs))
+	types := make([]ast.Expr, len(exprs))
+	last := -1
+	for i, expr := range exprs {
+		hoisted := v.hoisted
+		v.hoisted = nil
+		if call, ok := expr.(*ast.CallExpr); ok {
+			if name, args, ok := v.callee(call); ok && (v.currentMacro == "" || v.opts.Recursive) {
+				values[i], types[i] = v.expandHoisted(call, name, v.transformArgs(args))
+			}
+		}
+		if values[i] == nil {
+			values[i] = v.transformExpr(expr)
+		}
+		stmts[i], v.hoisted = v.hoisted, hoisted
+		if len(stmts[i]) > 0 {
+			last = i
+		}
+	}
+
+	for i := 0; i <= last; i++ {
+		switch _, literal := values[i].(*ast.BasicLit); {
+		case i == last:
+			v.hoisted = append(v.hoisted, stmts[i]...)
+		case len(stmts[i]) == 0 && literal:
+			// Evaluating the literal has no effect.
+		case len(stmts[i]) == 0:
+			sym := v.newSym()
+			v.hoisted = append(v.hoisted, &ast.AssignStmt{Lhs: []ast.Expr{sym}, Tok: token.DEFINE, Rhs: []ast.Expr{values[i]}})
+			values[i] = sym
+		case types[i] == nil:
+			v.errorf(exprs[i].Pos(), "%s expands to statements and has no result type, cannot evaluate it before %s",
+				v.source(exprs[i]), v.source(exprs[last]))
+		default:
+			sym := v.newSym()
+			v.hoisted = append(v.hoisted,
+				&ast.DeclStmt{Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{
+					&ast.ValueSpec{Names: []*ast.Ident{sym}, Type: types[i]},
+				}}},
+				&ast.BlockStmt{List: append(stmts[i], &ast.AssignStmt{
+					Lhs: []ast.Expr{ast.NewIdent(sym.Name)}, Tok: token.ASSIGN, Rhs: []ast.Expr{values[i]},
+				})},
+			)
+			values[i] = ast.NewIdent(sym.Name)
+		}
+	}
+	return values
+}
+
+// expandHoisted expands the call of the macro name with the arguments args
+// used as one of the values of a short variable declaration. The macro must
+// yield a single value, which replaces the call, and the statements before
+// its return statement are hoisted before the declaration. The declared
+// result type of the macro, if any, is returned with the value.
+func (v *visitor) expandHoisted(call *ast.CallExpr, name string, args []ast.Expr) (ast.Expr, ast.Expr) {
+	var value, typ ast.Expr = call, nil
+	v.instantiate(call, name, args, func(body []ast.Stmt) []ast.Node {
+		body, values := results(body)
+		if len(values) != 1 {
+			v.errorf(call.Pos(), "macro %q yields %d values and cannot be used as a value", name, len(values))
+			return nil
+		}
+		stmts := v.transformStmtList(body)
+		v.hoisted = append(v.hoisted, stmts...)
+		value = v.transformExpr(values[0])
+		if decl := v.decl(name); decl != nil {
+			if results := decl.Type.Results; results != nil && len(results.List) == 1 && len(results.List[0].Names) <= 1 {
+				typ = v.transformExpr(results.List[0].Type)
+			}
+		}
+
+		nodes := make([]ast.Node, 0, len(stmts)+1)
+		for _, stmt := range stmts {
+			nodes = append(nodes, stmt)
+		}
+		return append(nodes, value)
+	})
+	return value, typ
+}
+
+// expandValues expands the call of the macro name with the arguments args
+// used as the results of a return statement. The macro must consist of a
+// single return statement, whose results replace the call.
+func (v *visitor) expandValues(call *ast.CallExpr, name string, args []ast.Expr) []ast.Expr {
+	exprs := []ast.Expr{call}
+	v.instantiate(call, name, args, func(body []ast.Stmt) []ast.Node {
+		_, values := results(body)
+		exprs = make([]ast.Expr, len(values))
+		nodes := make([]ast.Node, len(values))
+		for i, value := range values {
+			exprs[i] = v.transformExpr(value)
+			nodes[i] = exprs[i]
+		}
+		return nodes
+	})
+	return exprs
+}
+
+// hasMacroCall reports whether node contains a macro call outside of
+// the nested blocks and clauses, which are expanded on their own.
+func (v *visitor) hasMacroCall(node ast.Node) bool {
+	found := false
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.BlockStmt, *ast.CaseClause, *ast.CommClause:
+			return false
+		case *ast.CallExpr:
+			if _, _, ok := v.callee(node); ok || isPseudoCall(node, raw) || isPseudoCall(node, ternary) {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+func (v *visitor) processBlock(block *ast.BlockStmt) {
+	stmts := make([]ast.Stmt, 0, len(block.List))
+
+	// The block starts a scope, holding the parameters of a function body.
+	declared := v.declared
+	v.declared = make(map[string]bool)
+	defer func() { v.declared = declared }()
+	for _, name := range v.params[block] {
+		v.declared[name] = true
+	}
+
+	// Walk all the statements.
+	for i, stmt := range block.List {
+		v.declare(stmts...)
+		if repl, ok := v.transformCustomStmt(stmt); ok {
+			stmts = append(stmts, repl)
+			continue
+		}
+		if call, name, args, ok := v.macroCall(stmt); ok {
+			// Replace the statement with an expanded
+			// list of statements.
+			for _, arg := range args {
+				ast.Walk(v, arg)
+			}
+			expansion := v.expand(call, name, v.transformArgs(args), nil)
+			v.anchor(stmt, expansion)
+			v.annotate(stmt, call, expansion)
+			v.attachComments(stmt, expansion)
+			v.dropLines(block, i, expansion)
+			stmts = append(stmts, expansion...)
+			continue
+		}
+		if assign, call, name, args, ok := v.assignCall(stmt); ok {
+			// Assign the results of the macro.
+			for _, arg := range args {
+				ast.Walk(v, arg)
+			}
+			expansion := v.expand(call, name, v.transformArgs(args), &ast.AssignStmt{
+				Lhs:    assign.Lhs,
+				TokPos: assign.TokPos,
+				Tok:    assign.Tok,
+			})
+			v.anchor(stmt, expansion)
+			v.annotate(stmt, call, expansion)
+			v.attachComments(stmt, expansion)
+			v.dropLines(block, i, expansion)
+			stmts = append(stmts, expansion...)
+			continue
+		}
+
+		ast.Walk(v, stmt)
+
+		if v.hasMacroCall(stmt) {
+			// Replace the macro calls used as values.
+			stmt = v.transformStmt(stmt)
+			stmts = append(stmts, v.hoisted...)
+			v.hoisted = nil
+		}
+		stmts = append(stmts, stmt)
+	}
+
+	// Replace the list of the block statements with a new (expanded) list.
+	block.List = stmts
+}
+
+// dropLines records the lines of the i-th statement of block, replaced
+// with expansion, to be left out of the line numbering of the formatted
+// result if the expansion has no positions. The printer only advances
+// in the lines of the source at the positioned tokens, so the lines
+// would otherwise be printed as blank lines after the expansion.
+func (v *visitor) dropLines(block *ast.BlockStmt, i int, expansion []ast.Stmt) {
+	for _, stmt := range expansion {
+		if hasPositions(stmt) {
+			return
+		}
+	}
+	stmt := block.List[i]
+	first, last := v.fset.Position(stmt.Pos()).Line, v.fset.Position(stmt.End()).Line
+	prev, next := block.Lbrace, block.Rbrace
+	if i > 0 {
+		prev = block.List[i-1].End()
+	}
+	if i < len(block.List)-1 {
+		next = block.List[i+1].Pos()
+	}
+	if prev.IsValid() && v.fset.Position(prev).Line >= first || next.IsValid() && v.fset.Position(next).Line <= last {
+		// The statement shares its lines with other code.
+		return
+	}
+	v.dropped = append(v.dropped, [2]int{first, last})
+}
+
+// anchor gives the first statement of expansion, replacing stmt, the
+// position of stmt if opts.KeepPositions is set, so that the printer
+// keeps the blank lines before stmt.
+func (v *visitor) anchor(stmt ast.Stmt, expansion []ast.Stmt) {
+	if v.opts.KeepPositions && v.currentMacro == "" && len(expansion) > 0 && !expansion[0].Pos().IsValid() {
+		setPos(reflect.ValueOf(expansion[0]), stmt.Pos())
+	}
+}
+
+// setPos sets the position of the first token of the node val to pos, and
+// reports whether it has found it. The fields of the nodes are in the order
+// of their tokens, so the first token is the first position found in them.
+func setPos(val reflect.Value, pos token.Pos) bool {
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if val.IsNil() {
+			return false
+		}
+		if _, ok := val.Interface().(*ast.CommentGroup); ok {
+			return false
+		}
+		return setPos(val.Elem(), pos)
+	case reflect.Slice:
+		for i := 0; i < val.Len(); i++ {
+			if setPos(val.Index(i), pos) {
+				return true
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < val.NumField(); i++ {
+			if field := val.Field(i); field.Type() == posType {
+				field.Set(reflect.ValueOf(pos))
+				return true
+			} else if setPos(field, pos) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasPositions reports whether some token of node has a position.
+func hasPositions(node ast.Node) bool {
+	found := false
+	ast.Inspect(node, func(node ast.Node) bool {
+		if node != nil && node.Pos().IsValid() {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// clone returns a deep copy of node, with the positions mapped through
+// pos if it is not nil. The objects, scopes and comments referred to by
+// node are shared with the copy.
+func clone(node ast.Node, pos func(token.Pos) token.Pos) ast.Node {
+	return cloneValue(reflect.ValueOf(node), pos).Interface().(ast.Node)
+}
+
+var posType = reflect.TypeOf(token.NoPos)
+
+func cloneValue(val reflect.Value, pos func(token.Pos) token.Pos) reflect.Value {
+	if val.Type() == posType && pos != nil {
+		return reflect.ValueOf(pos(token.Pos(val.Int())))
+	}
+	switch val.Kind() {
+	case reflect.Ptr:
+		if val.IsNil() {
+			return val
+		}
+		switch val.Interface().(type) {
+		case *ast.Object, *ast.Scope, *ast.CommentGroup:
+			return val
+		}
+		c := reflect.New(val.Type().Elem())
+		c.Elem().Set(cloneValue(val.Elem(), pos))
+		return c
+	case reflect.Interface:
+		if val.IsNil() {
+			return val
+		}
+		c := reflect.New(val.Type()).Elem()
+		c.Set(cloneValue(val.Elem(), pos))
+		return c
+	case reflect.Slice:
+		if val.IsNil() {
+			return val
+		}
+		c := reflect.MakeSlice(val.Type(), val.Len(), val.Len())
+		for i := 0; i < val.Len(); i++ {
+			c.Index(i).Set(cloneValue(val.Index(i), pos))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(val.Type()).Elem()
+		c.Set(val)
+		for i := 0; i < val.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(cloneValue(val.Field(i), pos))
+			}
+		}
+		return c
+	}
+	return val
+}
+
+// decl returns the declaration of the macro name, or nil.
+func (v *visitor) decl(name string) *ast.FuncDecl {
+	body := v.macros[name]
+	for decl := range v.defs {
+		if body != nil && decl.Body == body {
+			return decl
+		}
+	}
+	return nil
+}
+
+// define registers the macro defined by decl.
+func (v *visitor) define(decl *ast.FuncDecl) {
+	name := macroName(decl)
+	v.defs[decl] = true
+	if ns := namespace(decl); ns != "" {
+		v.namespaces[ns] = true
+	}
+
+	// Keep the first definition of the name.
+	if _, ok := v.macros[name]; ok {
+		prev := v.decl(name)
+		v.errorf(decl.Name.Pos(), "macro %q redeclared, previous definition at %s", name, v.fset.Position(prev.Name.Pos()))
+		return
+	}
+
+	// Save the macro body for later use.
+	v.macros[name] = decl.Body
+
+	// Save the macro params names.
+	var params []string
+	for _, p := range decl.Type.Params.List {
+		for _, ident := range p.Names {
+			params = append(params, ident.Name)
+		}
+		if ellipsis, ok := p.Type.(*ast.Ellipsis); ok {
+			v.variadic[name] = ellipsis.Elt
+		}
+	}
+	v.macroParams[name] = params
+
+	// Save the named results.
+	if results := decl.Type.Results; results != nil && len(results.List[0].Names) > 0 {
+		v.outputs[name] = results
+	}
+}
+
+// fieldNames returns the names declared in the list of fields.
+func fieldNames(list *ast.FieldList) []string {
+	var names []string
+	if list != nil {
+		for _, field := range list.List {
+			for _, ident := range field.Names {
+				names = append(names, ident.Name)
+			}
+		}
+	}
+	return names
+}
+
+// selected reports whether the macro name is to be expanded: all the
+// macros are, unless opts.Only restricts the expansion to some of them.
+func (v *visitor) selected(name string) bool {
+	if len(v.opts.Only) == 0 {
+		return true
+	}
+	for _, only := range v.opts.Only {
+		if only == name {
+			return true
+		}
+	}
+	return false
+}
+
+// collect registers the macros defined in file, except the ones
+// left out by opts.Only, and returns their declarations.
+func (v *visitor) collect(file *ast.File) []*ast.FuncDecl {
+	var defs []*ast.FuncDecl
+	imports := fileImports(file)
+	for _, decl := range file.Decls {
+		if decl, ok := decl.(*ast.FuncDecl); ok && isMacro(decl) {
+			if name := macroName(decl); !v.selected(name) {
+				// The macros left out are kept as functions, which
+				// the calls through a namespace cannot refer to.
+				if ns := namespace(decl); ns != "" {
+					v.errorf(decl.Name.Pos(), "macro %q of the namespace %s cannot be left out of the expansion", name, ns)
+				}
+				v.excluded[name] = true
+				continue
+			}
+			v.define(decl)
+			if _, ok := v.imports[macroName(decl)]; !ok {
+				v.imports[macroName(decl)] = requiredImports(decl, imports)
+			}
+			defs = append(defs, decl)
+		}
+	}
+	return defs
+}
+
+func (v *visitor) Visit(node ast.Node) ast.Visitor {
+	switch node := node.(type) {
+	case *ast.FuncDecl:
+		// A function declaration.
+		// Macro definitions have already been collected, skip them.
+		if v.defs[node] {
+			return nil
+		}
+		v.function = node
+		if node.Body != nil {
+			v.params[node.Body] = append(fieldNames(node.Recv), append(fieldNames(node.Type.Params), fieldNames(node.Type.Results)...)...)
+		}
+
+	case *ast.FuncLit:
+		// A function literal.
+		v.params[node.Body] = append(fieldNames(node.Type.Params), fieldNames(node.Type.Results)...)
 
 	case *ast.BlockStmt:
 		// A code block.
@@ -250,23 +2264,67 @@ func (v *visitor) Visit(node ast.Node) ast.Visitor {
 
 		return nil
 
+	case *ast.CaseClause:
+		// A case of a switch, expanded like a block.
+		for i, expr := range node.List {
+			ast.Walk(v, expr)
+			node.List[i] = v.transformExpr(expr)
+		}
+		block := &ast.BlockStmt{List: node.Body}
+		v.processBlock(block)
+		node.Body = block.List
+
+		return nil
+
+	case *ast.CommClause:
+		// A case of a select, expanded like a block.
+		if node.Comm != nil {
+			ast.Walk(v, node.Comm)
+			node.Comm = v.transformStmt(node.Comm)
+		}
+		block := &ast.BlockStmt{List: node.Body}
+		v.processBlock(block)
+		node.Body = block.List
+
+		return nil
+
 	case *ast.CallExpr:
 		// A function call.
-		// Check if it is a macro call.
-		if ident, ok := node.Fun.(*ast.Ident); ok {
-			if repl, ok := v.macros[ident.Name]; ok {
-				v.currentMacro = ident.Name
-
-				// Prepare a list of parameter substitutions.
-				v.replace = make([]ast.Expr, len(node.Args))
-				for i, a := range node.Args {
-					v.replace[i] = a
+		// Check if it calls an undefined macro of a namespace.
+		if fun, ok := node.Fun.(*ast.SelectorExpr); ok {
+			if x, ok := fun.X.(*ast.Ident); ok && v.namespaces[x.Name] {
+				if _, ok := v.macros[x.Name+"."+fun.Sel.Name]; !ok {
+					v.errorf(fun.Sel.Pos(), "undefined macro %s.%s", x.Name, fun.Sel.Name)
 				}
+			}
+		}
+		if isPseudoCall(node, raw) {
+			return nil
+		}
+		if _, args, ok := v.callee(node); ok {
+			// Only walk the arguments of a macro call.
+			for _, arg := range args {
+				ast.Walk(v, arg)
+			}
+			return nil
+		}
+
+	case *ast.SelectorExpr:
+		// The selected names are not macro references,
+		// except for the methods left out by opts.Only.
+		ast.Walk(v, node.X)
+		node.Sel.Name = v.unprefixed(node.Sel.Name)
 
-				// Expand this macro call.
-				v.expand(repl)
+		return nil
 
-				return nil
+	case *ast.Ident:
+		// A macro referenced not in a call.
+		if name := strings.TrimPrefix(node.Name, prefix); v.excluded[name] {
+			// A macro left out by opts.Only, kept as a function.
+			node.Name = name
+		} else if name != node.Name {
+			if _, ok := v.macros[name]; ok {
+				v.errorf(node.Pos(), "macro %q cannot be used as a value", name)
 			}
 		}
 	}
@@ -274,46 +2332,524 @@ func (v *visitor) Visit(node ast.Node) ast.Visitor {
 	return v
 }
 
-func main() {
-	log.SetFlags(0) // no date and time
-	flag.Parse()
+// isMacro reports whether decl is a macro definition. A function
+// with the MACRO_ prefix is an ordinary one if its doc comment
+// has the //macro:ignore directive.
+func isMacro(decl *ast.FuncDecl) bool {
+	if !strings.HasPrefix(decl.Name.Name, prefix) {
+		return false
+	}
+	return !hasDirective(decl, ignoreDirective)
+}
 
-	if len(flag.Args()) != 2 {
-		log.Fatal("Usage: macro [-r] input.go.tmpl output.go")
+// hasDirective reports whether the doc comment of decl
+// has the line directive.
+func hasDirective(decl *ast.FuncDecl, directive string) bool {
+	if decl.Doc != nil {
+		for _, c := range decl.Doc.List {
+			if c.Text == directive {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	// Parse the template.
-	fset := token.NewFileSet()
-	tree, err := parser.ParseFile(fset, flag.Arg(0), nil, parser.ParseComments)
-	if err != nil {
-		log.Fatal(err)
+// namespace returns the namespace of the macro declared by decl,
+// given by the //macro:namespace directive, or "" if there is none.
+func namespace(decl *ast.FuncDecl) string {
+	if decl.Doc != nil {
+		for _, c := range decl.Doc.List {
+			if ns, ok := strings.CutPrefix(c.Text, namespaceDirective); ok {
+				return strings.TrimSpace(ns)
+			}
+		}
 	}
+	return ""
+}
 
-	// Walk and transform the AST tree.
-	v := visitor{
+// macroName returns the name of the macro declared by decl: the name
+// of the function without the MACRO_ prefix, qualified with the
+// namespace of the macro, if any.
+func macroName(decl *ast.FuncDecl) string {
+	name := strings.TrimPrefix(decl.Name.Name, prefix)
+	if ns := namespace(decl); ns != "" {
+		return ns + "." + name
+	}
+	return name
+}
+
+// newVisitor returns a visitor with no macros defined yet.
+func newVisitor(fset *token.FileSet, opts Options) *visitor {
+	return &visitor{
+		fset:        fset,
+		opts:        opts,
 		macros:      make(map[string]*ast.BlockStmt),
+		defs:        make(map[*ast.FuncDecl]bool),
 		macroParams: make(map[string][]string),
+		namespaces:  make(map[string]bool),
+		cmap:        make(ast.CommentMap),
+		variadic:    make(map[string]ast.Expr),
+		outputs:     make(map[string]*ast.FieldList),
+		imports:     make(map[string][]importRef),
+		excluded:    make(map[string]bool),
+		packed:      make(map[*ast.CompositeLit]bool),
+		used:        make(map[string]bool),
+		params:      make(map[*ast.BlockStmt][]string),
+	}
+}
+
+// fork returns a new visitor sharing the macro definitions with v,
+// for expanding a file independently of the other ones.
+func (v *visitor) fork() *visitor {
+	w := &visitor{
+		fset:        v.fset,
+		opts:        v.opts,
+		macros:      v.macros,
+		defs:        v.defs,
+		macroParams: v.macroParams,
+		namespaces:  v.namespaces,
+		cmap:        v.cmap,
+		variadic:    v.variadic,
+		outputs:     v.outputs,
+		imports:     v.imports,
+		excluded:    v.excluded,
+		packed:      make(map[*ast.CompositeLit]bool),
+		used:        make(map[string]bool),
+		params:      make(map[*ast.BlockStmt][]string),
+		record:      v.opts.Invocations,
 	}
-	ast.Walk(&v, tree)
+	if v.opts.Stats {
+		w.stats = &Stats{Macros: len(v.macros), Counts: make(map[string]int)}
+	}
+	return w
+}
 
-	// Remove macro definitions.
+// transformTree walks and transforms tree, removes the macro definitions
+// and the imports only they used, and adds the imports the expansions need.
+func (v *visitor) transformTree(tree *ast.File) {
+	// Turn the kept macro definitions into ordinary functions, expanded
+	// like the rest of the code. Their bodies are shared by the expansions,
+	// so copies of the definitions are expanded instead.
+	docs := make(map[*ast.CommentGroup]*ast.CommentGroup)
+	for i, decl := range tree.Decls {
+		if decl, ok := decl.(*ast.FuncDecl); ok && v.defs[decl] && (v.opts.KeepDefs || hasDirective(decl, keepDirective)) {
+			kept := clone(decl, nil).(*ast.FuncDecl)
+			kept.Name.Name = strings.TrimPrefix(decl.Name.Name, prefix)
+			if decl.Doc != nil {
+				kept.Doc = v.keptDoc(decl.Doc, decl.Name.Name, kept.Name.Name)
+				docs[decl.Doc] = kept.Doc
+			}
+			tree.Decls[i] = kept
+		}
+	}
+
+	ast.Walk(v, tree)
+	for _, decl := range tree.Decls {
+		if decl, ok := decl.(*ast.GenDecl); ok {
+			v.transformGlobals(decl)
+		}
+	}
+
+	// Remove the other macro definitions.
 	decls := make([]ast.Decl, 0)
+	var removed []*ast.FuncDecl
 	for _, decl := range tree.Decls {
-		if decl, ok := decl.(*ast.FuncDecl); ok {
-			if strings.HasPrefix(decl.Name.Name, prefix) {
-				continue
-			}
+		if decl, ok := decl.(*ast.FuncDecl); ok && v.defs[decl] {
+			removed = append(removed, decl)
+			continue
 		}
 		decls = append(decls, decl)
 	}
 	tree.Decls = decls
+	removeImports(tree, removed)
+	v.addImports(tree)
+
+	// Drop the comments of the removed macro definitions,
+	// and the ones moved to the expansions of the calls.
+	moved := make(map[*ast.CommentGroup]bool)
+	for _, n := range v.notes {
+		for _, cg := range n.comments {
+			moved[cg] = true
+		}
+	}
+	comments := make([]*ast.CommentGroup, 0, len(tree.Comments))
+	for _, cg := range tree.Comments {
+		if doc, ok := docs[cg]; ok {
+			if doc != nil {
+				comments = append(comments, doc)
+			}
+		} else if !within(cg, removed) && !moved[cg] {
+			comments = append(comments, cg)
+		}
+	}
+	tree.Comments = comments
+}
+
+// keptDoc returns a copy of the doc comment of a kept macro definition,
+// without the //macro:keep directive, and with the name of the macro
+// replaced with the name of the function. The lines of the directive
+// are dropped from the formatted result.
+func (v *visitor) keptDoc(doc *ast.CommentGroup, name, function string) *ast.CommentGroup {
+	kept := &ast.CommentGroup{}
+	for _, c := range doc.List {
+		if c.Text == keepDirective {
+			first := v.fset.Position(c.Slash).Line
+			// Drop the empty line separating the directive too.
+			if n := len(kept.List); n > 0 && kept.List[n-1].Text == "//" {
+				first = v.fset.Position(kept.List[n-1].Slash).Line
+				kept.List = kept.List[:n-1]
+			}
+			v.dropped = append(v.dropped, [2]int{first, v.fset.Position(c.Slash).Line})
+			continue
+		}
+		kept.List = append(kept.List, &ast.Comment{Slash: c.Slash, Text: strings.ReplaceAll(c.Text, name, function)})
+	}
+	if len(kept.List) == 0 {
+		return nil
+	}
+	return kept
+}
 
-	// Write the formatted result.
-	f, err := os.OpenFile(flag.Arg(1), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+// format formats the transformed tree and returns the result.
+func (v *visitor) format(tree *ast.File) *Result {
+	output, err := formatFile(v.printFileSet(tree), tree, v.opts)
+	if err == nil {
+		output, err = v.insertComments(tree, output)
+	}
 	if err != nil {
-		log.Fatal(err)
+		v.errorf(tree.Package, "%v", err)
+	}
+
+	res := &Result{Output: output, Expansions: v.expansions, Stats: v.stats}
+	if v.opts.Invocations {
+		res.Invocations = v.locate(tree, res.Output)
+	}
+	return res
+}
+
+// printFileSet returns a file set holding a copy of the file of tree,
+// in which the dropped lines are merged into the preceding ones, so
+// that the printer does not see them.
+func (v *visitor) printFileSet(tree *ast.File) *token.FileSet {
+	if len(v.dropped) == 0 {
+		return v.fset
+	}
+	f := v.fset.File(tree.Package)
+	fset := token.NewFileSet()
+	file := fset.AddFile(f.Name(), f.Base(), f.Size())
+	file.SetLines(f.Lines())
+	dropped := append([][2]int{}, v.dropped...)
+	sort.Slice(dropped, func(i, j int) bool { return dropped[i][0] > dropped[j][0] })
+	for _, lines := range dropped {
+		// Merge the lines from the last one, so that the numbers
+		// of the lines before stay the same.
+		for line := lines[1]; line >= lines[0]; line-- {
+			file.MergeLine(line - 1)
+		}
+	}
+	return fset
+}
+
+// headerPrefix starts the header marking the expansion results.
+const headerPrefix = "// Code generated by macro from "
+
+// formatFile formats the transformed tree as the expansion result.
+func formatFile(fset *token.FileSet, tree *ast.File, opts Options) ([]byte, error) {
+	// Separate the file-level leading comments (build constraints,
+	// //go:generate lines and the like), so that they are emitted
+	// verbatim before the package clause.
+	var leading []*ast.CommentGroup
+	file := *tree
+	file.Comments = make([]*ast.CommentGroup, 0, len(tree.Comments))
+	for _, cg := range tree.Comments {
+		if cg.End() < tree.Package && cg != tree.Doc {
+			if strings.HasPrefix(cg.List[0].Text, headerPrefix) {
+				// Replace the header of an expansion result.
+				continue
+			}
+			leading = append(leading, cg)
+		} else {
+			file.Comments = append(file.Comments, cg)
+		}
+	}
+
+	var buf bytes.Buffer
+	if !opts.NoHeader {
+		// Mark the result as generated.
+		fmt.Fprintf(&buf, "%s%s; DO NOT EDIT.\n\n", headerPrefix, filepath.Base(fset.Position(tree.Package).Filename))
+	}
+	for _, cg := range leading {
+		for _, c := range cg.List {
+			buf.WriteString(c.Text)
+			buf.WriteByte('\n')
+		}
+		buf.WriteByte('\n')
+	}
+	ast.SortImports(fset, &file)
+	cfg := printerConfig(opts)
+	if err := cfg.Fprint(&buf, fset, &file); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// printerConfig returns the configuration of the printer for opts.
+func printerConfig(opts Options) *printer.Config {
+	cfg := &printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	if opts.TabWidth > 0 {
+		cfg.Tabwidth = opts.TabWidth
+	}
+	if opts.UseSpaces {
+		// Indent with spaces too.
+		cfg.Mode = printer.UseSpaces
+	}
+	return cfg
+}
+
+// within reports whether the comment group cg belongs to one of decls.
+func within(cg *ast.CommentGroup, decls []*ast.FuncDecl) bool {
+	for _, decl := range decls {
+		start := decl.Pos()
+		if decl.Doc != nil {
+			start = decl.Doc.Pos()
+		}
+		if start <= cg.Pos() && cg.End() <= decl.End() {
+			return true
+		}
+	}
+	return false
+}
+
+// Options control the macro expansion.
+type Options struct {
+	Recursive     bool              // expand macros recursively
+	KeepDefs      bool              // keep the macro definitions as ordinary functions, without the MACRO_ prefix
+	Werror        bool              // treat warnings as errors
+	Warnings      io.Writer         // where to report warnings; if nil, warnings are discarded
+	MacrosFile    string            // if not empty, read the macro definitions from this file instead of the templates
+	Strict        bool              // type-check the macro arguments and the results
+	Outputs       []string          // output files of the templates, left out of the Strict type-checking; if empty, derived from the names
+	NoHeader      bool              // do not emit the "Code generated" header
+	Jobs          int               // number of files to expand in parallel; if 0, GOMAXPROCS
+	Defines       map[string]string // symbols tested by IFDEF and IFNDEF, with their values
+	Invocations   bool              // record the expanded macro calls in the results
+	Trace         bool              // record the tree of the expansions in the results
+	Stats         bool              // collect the expansion statistics in the results
+	Only          []string          // if not empty, only expand these macros, and keep the other ones as functions
+	Annotate      bool              // precede the expansions of the macro call statements with a comment showing the call
+	TabWidth      int               // width of a tab in the output; if 0, 8
+	UseSpaces     bool              // indent the output with spaces instead of tabs
+	Log           *log.Logger       // if not nil, log each expansion
+	Transformers  []Transformer     // custom transformers consulted before the built-in handling
+	KeepPositions bool              // keep the positions of the code outside of the macros, preserving its layout
+}
+
+// A Transformer rewrites node. If it handles node, it returns the
+// replacement and true, and the built-in handling of node is skipped.
+// The transformers are called on the statements of the blocks, and on
+// every expression and statement of the expanded macro bodies.
+type Transformer func(node ast.Node) (ast.Node, bool)
+
+// A ParseError reports a template that is not valid Go source.
+type ParseError struct {
+	Filename string
+	Err      error // the error of the parser
+	Macros   bool  // whether the template uses macros
+}
+
+func (e *ParseError) Error() string {
+	if !e.Macros {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + "\n" + e.Note()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Note returns a hint on the templates using the macros.
+func (e *ParseError) Note() string {
+	return fmt.Sprintf("%s: note: the templates must be valid Go source, the macros are expanded after parsing", e.Filename)
+}
+
+// parseTemplate parses the template filename. The source
+// is read from the file if src is nil.
+func parseTemplate(fset *token.FileSet, filename string, src []byte) (*ast.File, error) {
+	if src == nil {
+		var err error
+		if src, err = os.ReadFile(filename); err != nil {
+			return nil, err
+		}
+	}
+	tree, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, &ParseError{Filename: filename, Err: err, Macros: bytes.Contains(src, []byte(prefix))}
+	}
+	return tree, nil
+}
+
+// Expand expands the macros in the template src and returns the
+// formatted result, and the expansion statistics if opts.Stats is set.
+// The filename is only used in positions.
+func Expand(filename string, src []byte, opts Options) ([]byte, *Stats, error) {
+	fset := token.NewFileSet()
+	tree, err := parseTemplate(fset, filename, src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results, err := expandFiles(fset, []*ast.File{tree}, opts, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return results[0].Output, results[0].Stats, nil
+}
+
+// ExpandFile expands the macros in the template f, parsed with
+// the comments into fset, and returns the transformed file, with the
+// macro definitions removed or, with KeepDefs, turned into ordinary
+// functions. f is modified in place. The expansion is not formatted,
+// so the "Code generated" header is not added, and the comments of the
+// macro bodies and of the expanded calls, which are only placed in
+// the formatted results, are lost. The expansion statistics are
+// returned if opts.Stats is set.
+func ExpandFile(fset *token.FileSet, f *ast.File, opts Options) (*ast.File, *Stats, error) {
+	results, err := expandFiles(fset, []*ast.File{f}, opts, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, results[0].Stats, nil
+}
+
+// A Result is the expansion of a template.
+type Result struct {
+	Output      []byte       // the formatted result
+	Invocations []Invocation // the expanded macro calls, if opts.Invocations is set
+	Expansions  []*Expansion // the tree of the expansions, if opts.Trace is set
+	Stats       *Stats       // the expansion statistics, if opts.Stats is set
+}
+
+// ExpandFiles reads the templates in filenames, expands the macros
+// and returns the results. Macros defined in any of the templates
+// can be used in all of them.
+func ExpandFiles(filenames []string, opts Options) ([]*Result, error) {
+	fset := token.NewFileSet()
+	trees := make([]*ast.File, len(filenames))
+	for i, filename := range filenames {
+		tree, err := parseTemplate(fset, filename, nil)
+		if err != nil {
+			return nil, err
+		}
+		trees[i] = tree
+	}
+
+	return expandFiles(fset, trees, opts, true)
+}
+
+// expandFiles expands the macros in the parsed templates and returns
+// the results, which are only formatted if format is set. If
+// opts.MacrosFile is not empty, the macros are defined in it instead,
+// and MACRO_-prefixed functions in the templates are left as they are.
+func expandFiles(fset *token.FileSet, trees []*ast.File, opts Options, format bool) ([]*Result, error) {
+	// Collect the macro definitions from all the templates
+	// or from the definitions file before anything is expanded,
+	// so that the macros can be used above their definitions.
+	v := newVisitor(fset, opts)
+	var defs []*ast.FuncDecl
+	var defsTrees []*ast.File
+	if opts.MacrosFile != "" {
+		tree, err := parseTemplate(fset, opts.MacrosFile, nil)
+		if err != nil {
+			return nil, err
+		}
+		defs = v.collect(tree)
+		defsTrees = []*ast.File{tree}
+	} else {
+		for _, tree := range trees {
+			defs = append(defs, v.collect(tree)...)
+		}
+	}
+
+	// Keep the comments of the statements, to move them
+	// to the statements they are expanded into.
+	for _, tree := range append(defsTrees, trees...) {
+		for node, groups := range ast.NewCommentMap(fset, tree, tree.Comments) {
+			v.cmap[node] = groups
+		}
+	}
+
+	if opts.Strict {
+		// Check the arguments before the calls are expanded.
+		v.checkArgs(trees, defsTrees, defs)
+	}
+
+	// Walk and transform the AST trees in parallel.
+	jobs := opts.Jobs
+	if jobs <= 0 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+	results := make([]*Result, len(trees))
+	workers := make([]*visitor, len(trees))
+	logs := make([]bytes.Buffer, len(trees))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, tree := range trees {
+		workers[i] = v.fork()
+		if opts.Log != nil {
+			// Keep the log of each template together.
+			workers[i].opts.Log = log.New(&logs[i], opts.Log.Prefix(), opts.Log.Flags())
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(w *visitor, i int, tree *ast.File) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			w.transformTree(tree)
+			if format || opts.Strict {
+				// The strict mode checks the formatted results.
+				results[i] = w.format(tree)
+			} else {
+				results[i] = &Result{Expansions: w.expansions, Stats: w.stats}
+			}
+		}(workers[i], i, tree)
+	}
+	wg.Wait()
+
+	// Merge the results of the workers.
+	for i, w := range workers {
+		if opts.Log != nil {
+			opts.Log.Writer().Write(logs[i].Bytes())
+		}
+		for name := range w.used {
+			v.used[name] = true
+		}
+		v.errs = append(v.errs, w.errs...)
+	}
+
+	// Report the macros that have never been used.
+	for _, def := range defs {
+		name := macroName(def)
+		if !v.used[name] {
+			v.warnf(def.Name.Pos(), "macro %q is never used", name)
+		}
+	}
+
+	if v.errs.Len() > 0 {
+		v.errs.Sort()
+		return nil, v.errs
+	}
+
+	if opts.Strict {
+		v.checkUndefined(trees, results)
+		if v.errs.Len() > 0 {
+			v.errs.Sort()
+			return nil, v.errs
+		}
 	}
-	defer f.Close()
 
-	format.Node(f, fset, tree)
+	return results, nil
 }
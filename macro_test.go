@@ -0,0 +1,703 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Update the golden files")
+
+// Each test expands testdata/<name>.in.go.tmpl and compares the result
+// with testdata/<name>.out.go, or checks that the expansion fails with
+// an error containing err.
+var tests = []struct {
+	name string
+	opts Options
+	err  string
+}{
+	{name: "exprs"},
+	{name: "stmts"},
+	{name: "assign"},
+	{name: "blocks"},
+	{name: "buildtags"},
+	{name: "comments"},
+	{name: "annotate", opts: Options{Annotate: true}},
+	{name: "method"},
+	{name: "namespace"},
+	{name: "variadic"},
+	{name: "pointers"},
+	{name: "select"},
+	{name: "switch", opts: Options{Recursive: true}},
+	{name: "results"},
+	{name: "returns"},
+	{name: "outputs"},
+	{name: "scopes"},
+	{name: "enum"},
+	{name: "types"},
+	{name: "builtins"},
+	{name: "containers"},
+	{name: "blank"},
+	{name: "defsonly"},
+	{name: "empty"},
+	{name: "values"},
+	{name: "single"},
+	{name: "init"},
+	{name: "transformers", opts: Options{Transformers: []Transformer{upperStrings, printlnToFmt}}},
+	{name: "spaces", opts: Options{TabWidth: 2, UseSpaces: true}},
+	{name: "positions", opts: Options{KeepPositions: true}},
+	{name: "ifdef", opts: Options{Defines: map[string]string{"DEBUG": "", "LEVEL": "2"}}},
+	{name: "ifndef", opts: Options{Defines: map[string]string{"MODE": "quiet"}}},
+	{name: "stringify"},
+	{name: "concat"},
+	{name: "fold"},
+	{name: "slices"},
+	{name: "asserts"},
+	{name: "generics"},
+	{name: "globals"},
+	{name: "gensym"},
+	{name: "funcname", opts: Options{Recursive: true}},
+	{name: "labels"},
+	{name: "raw"},
+	{name: "cond"},
+	{name: "recursive", opts: Options{Recursive: true}},
+	{name: "nested", opts: Options{Recursive: true}},
+	{name: "deferred", opts: Options{Recursive: true}},
+	{name: "forward", opts: Options{Recursive: true}},
+	{name: "compound", opts: Options{Recursive: true}},
+	{name: "callsite", opts: Options{Recursive: true}},
+	{name: "sole", opts: Options{Recursive: true}},
+	{name: "shortvar"},
+	{name: "ordered"},
+	{name: "keepdefs", opts: Options{KeepDefs: true}},
+	{name: "keep"},
+	{name: "keepcall", opts: Options{Recursive: true}},
+	{name: "ignore"},
+	{name: "only", opts: Options{Only: []string{"twice", "sum"}}},
+	{name: "strict", opts: Options{Strict: true}},
+	{name: "unused", opts: Options{Werror: true}, err: `macro "unused" is never used`},
+	{name: "badsyntax", err: "badsyntax.in.go.tmpl: note: the templates must be valid Go source"},
+	{name: "badconcat", err: `CONCAT: cannot concatenate "name"`},
+	{name: "badfold", err: `badfold.in.go.tmpl:4:6: FOLD: n is not a constant expression of literals`},
+	{name: "badzero", err: `badzero.in.go.tmpl:4:9: FOLD: invalid operation 1 / 0`},
+	{name: "badlitconcat", err: `badlitconcat.in.go.tmpl:4:28: LIT_CONCAT: name is not a string or integer literal`},
+	{name: "badhoist", err: `badhoist.in.go.tmpl:8:13: macro "pair" yields 2 values and cannot be used as a value`},
+	{name: "badglobals", err: `badglobals.in.go.tmpl:10:11: macro "twice" expands to statements and cannot be used as a value`},
+	{name: "badcond", err: `badcond.in.go.tmpl:5:10: COND: cannot infer the type of the result, pass it as the fourth argument`},
+	{name: "badstringify", err: "STRINGIFY expects 1 argument, got 2"},
+	{name: "badselector", err: "cannot use p.x as a selector"},
+	{name: "badrange", err: `badrange.in.go.tmpl:6:9: cannot use p.x as a declared name`},
+	{name: "undefined", opts: Options{Strict: true}, err: `undefined.in.go.tmpl:6:17: undefined: total (in macro "report")`},
+	{name: "badarg", opts: Options{Strict: true}, err: `badarg.in.go.tmpl:15:2: cannot use 42 (type untyped int) as string value in argument 1 to macro "show"`},
+	{name: "badreceiver", err: `badreceiver.in.go.tmpl:8:4: macro "hello" has no parameter for the receiver x`},
+	{name: "badfuncname", err: `badfuncname.in.go.tmpl:4:2: RECEIVER used outside of a method with a named receiver`},
+	{name: "badarity", err: `badarity.in.go.tmpl:8:2: macro "add" expects 2 arguments, got 1`},
+	{name: "badresults", err: `badresults.in.go.tmpl:8:7: assignment mismatch: 1 variables but macro "divmod" yields 2 values`},
+	{name: "badoutputs", err: `badoutputs.in.go.tmpl:8:8: assignment mismatch: 1 variables but macro "minmax" has 2 results`},
+	{name: "redeclared", err: `redeclared.in.go.tmpl:7:6: macro "show" redeclared, previous definition at testdata/redeclared.in.go.tmpl:3:6`},
+	{name: "badvalue", err: `badvalue.in.go.tmpl:10:14: macro "show" yields 0 values and cannot be used as a value`},
+	{name: "badspread", err: `badspread.in.go.tmpl:9:11: cannot use ... in call to non-variadic macro "add"`},
+	{name: "badnamespace", err: `badnamespace.in.go.tmpl:9:36: undefined macro ints.Min`},
+	{name: "badsingle", err: `badsingle.in.go.tmpl:11:22: macro "step" expands to 2 statements and cannot be used as a single statement`},
+	{name: "badmulti", err: `badmulti.in.go.tmpl:13:14: macro "checked" expands to statements and cannot be used as a value`},
+	{name: "badreturn", err: `badreturn.in.go.tmpl:11:9: macro "checked" expands to statements and cannot be used in a return statement`},
+	{name: "badswitch", err: `badswitch.in.go.tmpl:11:9: macro "checked" expands to statements and cannot be used as a switch tag`},
+	{name: "baddefer", err: `baddefer.in.go.tmpl:10:8: macro "report" expands to statements and cannot be called with defer`},
+	{name: "badref", err: `badref.in.go.tmpl:15:20: macro "double" cannot be used as a value`},
+	{name: "selfcall", opts: Options{Recursive: true}, err: `macro "forever": expansion is nested too deeply`},
+	{name: "badonly", opts: Options{Only: []string{"ints.Clamp", "log.Show"}}, err: `badonly.in.go.tmpl:13:6: macro "floats.Clamp" of the namespace floats cannot be left out of the expansion`},
+}
+
+// upperStrings turns the string literals to upper case.
+func upperStrings(node ast.Node) (ast.Node, bool) {
+	lit, ok := node.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return nil, false
+	}
+	return &ast.BasicLit{Kind: token.STRING, Value: strings.ToUpper(lit.Value)}, true
+}
+
+// printlnToFmt replaces the println statements with fmt.Println.
+func printlnToFmt(node ast.Node) (ast.Node, bool) {
+	stmt, ok := node.(*ast.ExprStmt)
+	if !ok {
+		return nil, false
+	}
+	call, ok := stmt.X.(*ast.CallExpr)
+	if !ok {
+		return nil, false
+	}
+	if fun, ok := call.Fun.(*ast.Ident); !ok || fun.Name != "println" {
+		return nil, false
+	}
+	return &ast.ExprStmt{X: &ast.CallExpr{
+		Fun:  &ast.SelectorExpr{X: ast.NewIdent("fmt"), Sel: ast.NewIdent("Println")},
+		Args: call.Args,
+	}}, true
+}
+
+func TestExpand(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := filepath.Join("testdata", test.name+".in.go.tmpl")
+			src, err := os.ReadFile(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, _, err := Expand(in, src, test.opts)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("want error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", test.name+".out.go")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("%s differs from the expected output:\n%s", in, diff(golden, want, "got", got))
+			}
+		})
+	}
+}
+
+// TestVet checks that the golden files are valid Go code.
+func TestVet(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if testing.Short() || err != nil {
+		t.Skip("skipping go vet of the golden files")
+	}
+	vet := func(t *testing.T, files ...string) {
+		t.Parallel()
+		if out, err := exec.Command(goTool, append([]string{"vet"}, files...)...).CombinedOutput(); err != nil {
+			t.Errorf("go vet: %v\n%s", err, out)
+		}
+	}
+	for _, test := range tests {
+		if test.err != "" {
+			continue
+		}
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			vet(t, filepath.Join("testdata", test.name+".out.go"))
+		})
+	}
+	t.Run("multi", func(t *testing.T) {
+		files, err := filepath.Glob(filepath.Join("testdata", "multi", "*.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vet(t, files...)
+	})
+}
+
+// TestLayout checks that the expansions add no blank lines to the
+// functions of the templates.
+func TestLayout(t *testing.T) {
+	// blankLines returns the number of blank lines in the bodies
+	// of the functions of the file filename.
+	blankLines := func(t *testing.T, filename string) map[string]int {
+		src, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, filename, src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blanks := make(map[string]int)
+		for _, decl := range f.Decls {
+			if decl, ok := decl.(*ast.FuncDecl); ok && decl.Body != nil {
+				body := src[fset.Position(decl.Body.Lbrace).Offset:fset.Position(decl.Body.Rbrace).Offset]
+				blanks[strings.TrimPrefix(decl.Name.Name, prefix)] += strings.Count(string(body), "\n\n")
+			}
+		}
+		return blanks
+	}
+	for _, test := range tests {
+		if test.err != "" {
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			in := blankLines(t, filepath.Join("testdata", test.name+".in.go.tmpl"))
+			out := blankLines(t, filepath.Join("testdata", test.name+".out.go"))
+			for name, n := range out {
+				if n > in[name] {
+					t.Errorf("%s has %d blank lines in the output, %d in the template", name, n, in[name])
+				}
+			}
+		})
+	}
+}
+
+func TestGensym(t *testing.T) {
+	src := []byte(`package main
+
+func MACRO_fresh() {
+	GENSYM() := GENSYM()
+}
+
+func main() {
+	fresh()
+}
+`)
+	got, _, err := Expand("fresh.go.tmpl", src, Options{NoHeader: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "_gen_0 := _gen_1"; !strings.Contains(string(got), want) {
+		t.Errorf("want the output to contain %q, got\n%s", want, got)
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	for _, test := range tests {
+		if test.err != "" {
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			in := filepath.Join("testdata", test.name+".in.go.tmpl")
+			once, err := os.ReadFile(filepath.Join("testdata", test.name+".out.go"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			twice, _, err := Expand(in, once, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(twice) != string(once) {
+				t.Errorf("expanding %s again changes it:\n%s", in, diff("once", once, "twice", twice))
+			}
+		})
+	}
+}
+
+func TestCheckIdempotent(t *testing.T) {
+	in := filepath.Join("testdata", "multi", "use.go.tmpl")
+	src, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Werror: true, MacrosFile: filepath.Join("testdata", "multi", "defs.go.tmpl")}
+	once, _, err := Expand(in, src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkIdempotent(in, once, opts); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpandFile(t *testing.T) {
+	in := filepath.Join("testdata", "results.in.go.tmpl")
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, in, nil, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, _, err = ExpandFile(fset, f, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range f.Decls {
+		if decl, ok := decl.(*ast.FuncDecl); ok && decl.Name.Name != "main" {
+			t.Errorf("unexpected declaration of %s", decl.Name.Name)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		t.Fatal(err)
+	}
+	golden, err := os.ReadFile(filepath.Join("testdata", "results.out.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Skip the header.
+	_, want, _ := strings.Cut(string(golden), "\n\n")
+	if got := buf.String(); got != want {
+		t.Errorf("want\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestSoleStatement(t *testing.T) {
+	in := filepath.Join("testdata", "sole.in.go.tmpl")
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, in, nil, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, _, err = ExpandFile(fset, f, Options{Recursive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range f.Decls {
+		decl, ok := decl.(*ast.FuncDecl)
+		if !ok || decl.Name.Name != "main" && decl.Name.Name != "guest" {
+			continue
+		}
+		// The body is the expansion of greet.
+		if n := len(decl.Body.List); n != 3 {
+			t.Errorf("%s: want 3 statements, got %d", decl.Name.Name, n)
+		}
+	}
+}
+
+func TestExpandFiles(t *testing.T) {
+	ins, err := templates(filepath.Join("testdata", "multi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := ExpandFiles(ins, Options{Jobs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, in := range ins {
+		golden, _ := outputName(in)
+		if *update {
+			if err := os.WriteFile(golden, results[i].Output, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(results[i].Output) != string(want) {
+			t.Errorf("%s differs from the expected output:\n%s", in, diff(golden, want, "got", results[i].Output))
+		}
+	}
+}
+
+func TestStrictOutputs(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("testdata", "undefined.in.go.tmpl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "report.go.tmpl")
+	if err := os.WriteFile(in, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A stale output, without the header, declaring the undefined name.
+	out := filepath.Join(dir, "stale.go")
+	if err := os.WriteFile(out, []byte("package main\n\nvar total int\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ExpandFiles([]string{in}, Options{Strict: true, Outputs: []string{out}})
+	if want := `undefined: total (in macro "report")`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("want error containing %q, got %v", want, err)
+	}
+
+	// An untyped constant not representable as the parameter type.
+	in = filepath.Join(dir, "half.go.tmpl")
+	src = []byte(`package main
+
+func MACRO_h(n int) {
+	println(n / 2)
+}
+
+func main() {
+	h(2.5)
+	h(4.0)
+	h(1 << 70)
+}
+`)
+	if err := os.WriteFile(in, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ExpandFiles([]string{in}, Options{Strict: true, Outputs: []string{out}})
+	want := []string{
+		`half.go.tmpl:8:2: cannot use 2.5 (type untyped float) as int value in argument 1 to macro "h"`,
+		`half.go.tmpl:10:2: cannot use 1 << 70 (type untyped int) as int value in argument 1 to macro "h"`,
+	}
+	list, ok := err.(scanner.ErrorList)
+	if !ok || len(list) != len(want) {
+		t.Fatalf("want %d errors, got %v", len(want), err)
+	}
+	for i, err := range list {
+		if !strings.HasSuffix(err.Error(), want[i]) {
+			t.Errorf("want error ending with %q, got %v", want[i], err)
+		}
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	ins := []string{filepath.Join("a", "x.go.tmpl"), filepath.Join("b", "x.go.tmpl")}
+	_, err := outputs("out", ins)
+	if want := "is also the output of"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("want error containing %q, got %v", want, err)
+	}
+}
+
+func TestInvocations(t *testing.T) {
+	in := filepath.Join("testdata", "multi", "use.go.tmpl")
+	results, err := ExpandFiles([]string{in}, Options{
+		MacrosFile:  filepath.Join("testdata", "multi", "defs.go.tmpl"),
+		Invocations: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := results[0]
+	if len(res.Invocations) != 2 {
+		t.Fatalf("want 2 invocations, got %d", len(res.Invocations))
+	}
+	for i, inv := range res.Invocations {
+		if inv.Macro != "inc" || len(inv.Args) != 1 || inv.Args[0] != "a" {
+			t.Errorf("invocation %d: unexpected %+v", i, inv)
+		}
+		if inv.Pos.Line != 4+i {
+			t.Errorf("invocation %d: want the call at line %d, got %d", i, 4+i, inv.Pos.Line)
+		}
+		if got := string(res.Output[inv.Start:inv.End]); got != "a = a + 1" {
+			t.Errorf("invocation %d: want a = a + 1, got %q", i, got)
+		}
+	}
+}
+
+func TestImports(t *testing.T) {
+	in := filepath.Join("testdata", "imports", "use.go.tmpl")
+	results, err := ExpandFiles([]string{in}, Options{
+		MacrosFile: filepath.Join("testdata", "imports", "defs.go.tmpl"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden, _ := outputName(in)
+	if *update {
+		if err := os.WriteFile(golden, results[0].Output, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := results[0].Output; string(got) != string(want) {
+		t.Errorf("%s differs from the expected output:\n%s", in, diff(golden, want, "got", got))
+	}
+}
+
+func TestLog(t *testing.T) {
+	in := filepath.Join("testdata", "results.in.go.tmpl")
+	src, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, _, err := Expand(in, src, Options{Log: log.New(&buf, "", 0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		in + ":18:14: expanding divmod with 2 arguments at depth 1",
+		in + ":20:13: expanding divmod with 2 arguments at depth 1",
+		in + ":21:7: expanding twice with 1 arguments at depth 1",
+	}
+	if got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want the log\n%s\ngot\n%s", strings.Join(want, "\n"), buf.String())
+	}
+
+	// The logs of the templates expanded in parallel are not interleaved.
+	ins, err := templates(filepath.Join("testdata", "multi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if _, err := ExpandFiles(ins, Options{Jobs: len(ins), Log: log.New(&buf, "", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	last := 0
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		i := 0
+		for i < len(ins) && !strings.HasPrefix(line, ins[i]+":") {
+			i++
+		}
+		if i < last {
+			t.Fatalf("the log of %s follows the one of %s:\n%s", ins[i], ins[last], buf.String())
+		}
+		last = i
+	}
+}
+
+func TestTrace(t *testing.T) {
+	in := filepath.Join("testdata", "callsite.in.go.tmpl")
+	results, err := ExpandFiles([]string{in}, Options{Recursive: true, Trace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	var walk func(exps []*Expansion, indent string)
+	walk = func(exps []*Expansion, indent string) {
+		for _, exp := range exps {
+			got = append(got, fmt.Sprintf("%s%s(%s) at %d:%d", indent, exp.Macro, strings.Join(exp.Args, ", "), exp.Pos.Line, exp.Pos.Column))
+			walk(exp.Nested, indent+"\t")
+		}
+	}
+	walk(results[0].Expansions, "")
+	want := []string{
+		"showSquare(n) at 22:2",
+		"\tsquare(n) at 6:7",
+		"\tshow(n * n) at 6:2",
+		"\tshow(n) at 8:3",
+		"showSquare(n + 1) at 23:2",
+		"\tsquare(n + 1) at 6:7",
+		"\tshow((n + 1) * (n + 1)) at 6:2",
+		"\tshow(n + 1) at 8:3",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want the trace\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestStats(t *testing.T) {
+	in := filepath.Join("testdata", "callsite.in.go.tmpl")
+	opts := Options{Recursive: true, Stats: true}
+	want := &Stats{
+		Macros:     3,
+		Expansions: 8,
+		Counts:     map[string]int{"showSquare": 2, "square": 2, "show": 4},
+		MaxDepth:   2,
+	}
+
+	results, err := ExpandFiles([]string{in}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := results[0].Stats; !reflect.DeepEqual(got, want) {
+		t.Errorf("ExpandFiles: want the stats %+v, got %+v", want, got)
+	}
+
+	src, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, got, err := Expand(in, src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expand: want the stats %+v, got %+v", want, got)
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, in, src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err = ExpandFile(fset, f, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExpandFile: want the stats %+v, got %+v", want, got)
+	}
+}
+
+func TestListMacros(t *testing.T) {
+	macros, err := ListMacros([]string{
+		filepath.Join("testdata", "results.in.go.tmpl"),
+		filepath.Join("testdata", "listed.in.go.tmpl"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Macro{
+		{Name: "divmod", Signature: "(a, b int) (int, int)", Expr: true},
+		{Name: "show", Signature: "(label string, x int)"},
+		{Name: "twice", Signature: "(x int) int", Expr: true},
+	}
+	if len(macros) != len(want) {
+		t.Fatalf("want %d macros, got %d", len(want), len(macros))
+	}
+	for i, m := range macros {
+		if m.Name != want[i].Name || m.Signature != want[i].Signature || m.Expr != want[i].Expr {
+			t.Errorf("macro %d: want %+v, got %+v", i, want[i], m)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := []byte("a\nb\nc\nd\ne\n")
+	new := []byte("a\nc\nd\nx\ne\n")
+	want := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ a
+-b
+ c
+ d
++x
+ e
+`
+	if got := string(diff("old", old, "new", new)); got != want {
+		t.Errorf("want\n%s\ngot\n%s", want, got)
+	}
+
+	// A large file with a single change.
+	var lines []string
+	for i := 0; i < 100000; i++ {
+		lines = append(lines, fmt.Sprint(i))
+	}
+	old = []byte(strings.Join(lines, "\n") + "\n")
+	lines[50000] = "changed"
+	new = []byte(strings.Join(lines, "\n") + "\n")
+	want = "@@ -49998,7 +49998,7 @@\n 49997\n 49998\n 49999\n-50000\n+changed\n 50001\n"
+	if got := string(diff("old", old, "new", new)); !strings.Contains(got, want) {
+		t.Errorf("want a diff containing\n%s\ngot\n%s", want, got)
+	}
+}
@@ -0,0 +1,501 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// tmplExt is stripped from a template name to get the output name.
+const tmplExt = ".tmpl"
+
+var (
+	recursive = flag.Bool("r", false, "Expand macros recursively")
+	showDiff  = flag.Bool("d", false, "Display a diff against the existing output file instead of writing it")
+	write     = flag.Bool("w", false, "Write the result to the output file (derived from the input name if omitted)")
+	list      = flag.Bool("l", false, "List output files whose contents would change")
+	keepDefs  = flag.Bool("keep-defs", false, "Keep the macro definitions in the output as ordinary functions, without the MACRO_ prefix")
+	werror    = flag.Bool("Werror", false, "Treat warnings as errors")
+	strict    = flag.Bool("strict", false, "Type-check the macro arguments and the results")
+	noHeader  = flag.Bool("no-header", false, "Do not emit the \"Code generated\" header")
+	jobs      = flag.Int("j", runtime.GOMAXPROCS(0), "Number of templates to expand in parallel")
+	jsonFile  = flag.String("json", "", "Write a JSON report of the expanded macro calls to `file`")
+	tabWidth  = flag.Int("tabwidth", 8, "Tab width of the output")
+	useSpaces = flag.Bool("use-spaces", false, "Indent the output with spaces instead of tabs")
+	formatter = flag.String("formatter", "", "Pipe the output through the `command`, e.g. goimports (not with -json)")
+	verbose   = flag.Bool("v", false, "Log each macro expansion to stderr")
+	macroDefs = flag.String("macros", "", "Read the macro definitions from `file` instead of the templates")
+	keepPos   = flag.Bool("keep-positions", false, "Preserve the layout of the code outside of the macros")
+	traceFile = flag.String("trace-output", "", "Write the tree of the expansions to `file`")
+	only      = flag.String("only", "", "Only expand the comma-separated `names` of macros, and keep the other ones as functions")
+	annotate  = flag.Bool("annotate", false, "Precede the expanded code with a comment showing the macro call")
+	checkIdem = flag.Bool("check-idempotent", false, "Check that expanding the results again leaves them unchanged, instead of writing them")
+	outDir    = flag.String("o", "", "Write the output files to the `directory`, created if needed")
+	stats     = flag.Bool("stats", false, "Print the expansion statistics to stderr")
+)
+
+var defines = make(defineFlag)
+
+func init() {
+	flag.Var(defines, "D", "Define the `name[=value]` symbol for IFDEF and IFNDEF (may be repeated)")
+}
+
+var exitCode = 0
+
+// Exit codes of the errors, besides 2 for the usage errors.
+const (
+	exitError = 1 // expansion and I/O errors
+	exitParse = 3 // a template cannot be parsed
+)
+
+// fatal prints the error err, starting with the name of the file
+// it is about, as in file: message, and exits with exitError.
+func fatal(err error) {
+	var perr *os.PathError
+	if errors.As(err, &perr) {
+		err = fmt.Errorf("%s: %s: %v", perr.Path, perr.Op, perr.Err)
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(exitError)
+}
+
+// printError prints the error err, one file:line:col: message line per
+// error of a list, and exits: with exitParse if it is a parse error,
+// and with exitError otherwise.
+func printError(err error) {
+	var perr *ParseError
+	if errors.As(err, &perr) {
+		scanner.PrintError(os.Stderr, perr.Err)
+		if perr.Macros {
+			fmt.Fprintln(os.Stderr, perr.Note())
+		}
+		os.Exit(exitParse)
+	}
+	if _, ok := err.(scanner.ErrorList); !ok {
+		fatal(err)
+	}
+	scanner.PrintError(os.Stderr, err)
+	os.Exit(exitError)
+}
+
+// defineFlag collects the repeated -D name[=value] flags.
+type defineFlag map[string]string
+
+func (f defineFlag) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (f defineFlag) Set(s string) error {
+	name, value, _ := strings.Cut(s, "=")
+	if !token.IsIdentifier(name) {
+		return fmt.Errorf("invalid symbol name %q", name)
+	}
+	f[name] = value
+	return nil
+}
+
+// templates returns the names of the templates in the directory dir.
+func templates(dir string) ([]string, error) {
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.go"+tmplExt))
+	if err != nil {
+		return nil, err
+	}
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("%s: no *.go%s files", dir, tmplExt)
+	}
+	return filenames, nil
+}
+
+// outputName derives the name of the generated file from the name
+// of the template by stripping the .tmpl extension.
+func outputName(in string) (string, error) {
+	if !strings.HasSuffix(in, tmplExt) {
+		return "", fmt.Errorf("%s: cannot derive the output file name: no %s extension", in, tmplExt)
+	}
+	return strings.TrimSuffix(in, tmplExt), nil
+}
+
+// outputs returns the names of the output files of the templates ins
+// in the directory dir. It fails if an output would overwrite one of
+// the sources, or the output of another template.
+func outputs(dir string, ins []string) ([]string, error) {
+	sources := append([]string{}, ins...)
+	if *macroDefs != "" {
+		sources = append(sources, *macroDefs)
+	}
+	outs := make([]string, len(ins))
+	for i, in := range ins {
+		out, err := outputName(in)
+		if err != nil {
+			return nil, err
+		}
+		outs[i] = filepath.Join(dir, filepath.Base(out))
+		for _, source := range sources {
+			if sameFile(outs[i], source) {
+				return nil, fmt.Errorf("%s: refusing to overwrite the source file %s", in, source)
+			}
+		}
+		for j, prev := range outs[:i] {
+			if sameFile(outs[i], prev) {
+				return nil, fmt.Errorf("%s: output file %s is also the output of %s", in, outs[i], ins[j])
+			}
+		}
+	}
+	return outs, nil
+}
+
+// sameFile reports whether the names a and b denote the same file.
+func sameFile(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
+
+// writeResult writes, lists or diffs, depending on the flags,
+// the expansion result res for the output file out. If out is empty,
+// the result is written to the standard output.
+func writeResult(out string, res []byte) error {
+	if out == "" {
+		_, err := os.Stdout.Write(res)
+		return err
+	}
+
+	// Compare with the existing output file, if any.
+	old, err := os.ReadFile(out)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if bytes.Equal(old, res) {
+		return nil
+	}
+
+	if *list {
+		fmt.Println(out)
+	}
+	if *showDiff {
+		os.Stdout.Write(diff(out+".orig", old, out, res))
+		exitCode = 1
+	}
+	if *write || !*list && !*showDiff {
+		// Write the formatted result.
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(out, res, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkIdempotent expands the expansion result res of the template in
+// again, and prints a diff if the result changes.
+func checkIdempotent(in string, res []byte, opts Options) error {
+	// The macros are not used again, so the result would be reported
+	// as not using them: the warnings of the second expansion are discarded.
+	opts.Werror, opts.Warnings = false, nil
+	again, _, err := Expand(in, res, opts)
+	if err != nil {
+		return err
+	}
+	if d := diff(in+" (expanded once)", res, in+" (expanded twice)", again); d != nil {
+		os.Stdout.Write(d)
+		exitCode = 1
+	}
+	return nil
+}
+
+// reformat pipes the expansion result res of the template in
+// through the formatter command line and returns its output.
+func reformat(command, in string, res []byte) ([]byte, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s: empty formatter command", in)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(res)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %v", in, args[0], err)
+	}
+	return out, nil
+}
+
+// writeReport writes the JSON report of the macro calls
+// expanded in the templates ins to the file name.
+func writeReport(name string, ins, outs []string, results []*Result) error {
+	type fileReport struct {
+		Template    string       `json:"template"`
+		Output      string       `json:"output,omitempty"`
+		Invocations []Invocation `json:"invocations"`
+	}
+	report := make([]fileReport, len(results))
+	for i, res := range results {
+		report[i] = fileReport{
+			Template:    ins[i],
+			Output:      outs[i],
+			Invocations: res.Invocations,
+		}
+	}
+
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0644)
+}
+
+// writeTrace writes the trees of the expansions of the templates ins
+// to the file name, one line per expansion, indented by the nesting.
+func writeTrace(name string, ins []string, results []*Result) error {
+	var buf bytes.Buffer
+	var write func(exps []*Expansion, indent string)
+	write = func(exps []*Expansion, indent string) {
+		for _, exp := range exps {
+			fmt.Fprintf(&buf, "%s%s(%s) at %s\n", indent, exp.Macro, strings.Join(exp.Args, ", "), exp.Pos)
+			write(exp.Nested, indent+"\t")
+		}
+	}
+	for i, res := range results {
+		fmt.Fprintf(&buf, "%s:\n", ins[i])
+		write(res.Expansions, "\t")
+	}
+	return os.WriteFile(name, buf.Bytes(), 0644)
+}
+
+// printStats prints the expansion statistics of all the results to stderr:
+// the totals, then the number of expansions of each macro.
+func printStats(results []*Result) {
+	var total Stats
+	for _, res := range results {
+		total.Add(res.Stats)
+	}
+	fmt.Fprintf(os.Stderr, "%d macros, %d expansions, max depth %d\n", total.Macros, total.Expansions, total.MaxDepth)
+	names := make([]string, 0, len(total.Counts))
+	for name := range total.Counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "\t%s\t%d\n", name, total.Counts[name])
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: macro [flags] input.go.tmpl [output.go]")
+	fmt.Fprintln(os.Stderr, "       macro [flags] directory")
+	fmt.Fprintln(os.Stderr, "       macro [flags] -o outdir input.go.tmpl|directory...")
+	fmt.Fprintln(os.Stderr, "       macro list input.go.tmpl|directory...")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "Exit status: 1 on errors or differences (-d, -check-idempotent), 2 on usage errors, 3 if a template cannot be parsed.")
+	os.Exit(2)
+}
+
+// listMacros prints the macros defined in the templates or in the
+// directories of templates args, one per line: the name, the signature
+// and the kind of the macro, separated by tabs.
+func listMacros(args []string) {
+	var filenames []string
+	for _, arg := range args {
+		if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+			ins, err := templates(arg)
+			if err != nil {
+				fatal(err)
+			}
+			filenames = append(filenames, ins...)
+		} else {
+			filenames = append(filenames, arg)
+		}
+	}
+
+	macros, err := ListMacros(filenames)
+	if err != nil {
+		printError(err)
+	}
+	for _, m := range macros {
+		kind := "statement"
+		if m.Expr {
+			kind = "expression"
+		}
+		fmt.Printf("%s\t%s\t%s\n", m.Name, m.Signature, kind)
+	}
+}
+
+func main() {
+	log.SetFlags(0) // no date and time
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.Arg(0) == "list" {
+		if flag.NArg() < 2 {
+			usage()
+		}
+		listMacros(flag.Args()[1:])
+		return
+	}
+
+	if flag.NArg() < 1 || flag.NArg() > 2 && *outDir == "" {
+		usage()
+	}
+	if *formatter != "" && len(strings.Fields(*formatter)) == 0 {
+		fmt.Fprintln(os.Stderr, "-formatter: empty command")
+		usage()
+	}
+	if *formatter != "" && *jsonFile != "" {
+		// The offsets of the report would point into the unformatted results.
+		fmt.Fprintln(os.Stderr, "-formatter: cannot be used with -json")
+		usage()
+	}
+
+	var ins, outs []string
+	if *outDir != "" {
+		// Write the outputs of all the templates to the directory.
+		for _, arg := range flag.Args() {
+			if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+				filenames, err := templates(arg)
+				if err != nil {
+					fatal(err)
+				}
+				ins = append(ins, filenames...)
+			} else {
+				ins = append(ins, arg)
+			}
+		}
+		var err error
+		if outs, err = outputs(*outDir, ins); err != nil {
+			fatal(err)
+		}
+	} else if fi, err := os.Stat(flag.Arg(0)); err == nil && fi.IsDir() {
+		// Process all the templates in the directory.
+		if flag.NArg() != 1 {
+			usage()
+		}
+		if ins, err = templates(flag.Arg(0)); err != nil {
+			fatal(err)
+		}
+		for _, in := range ins {
+			out, err := outputName(in)
+			if err != nil {
+				fatal(err)
+			}
+			outs = append(outs, out)
+		}
+	} else {
+		in, out := flag.Arg(0), flag.Arg(1)
+		if out == "" && (*write || *list || *showDiff) {
+			if out, err = outputName(in); err != nil {
+				fatal(err)
+			}
+		}
+		if out == in {
+			fatal(fmt.Errorf("%s: refusing to overwrite the input file", in))
+		}
+		ins, outs = []string{in}, []string{out}
+	}
+
+	opts := Options{
+		Recursive:   *recursive,
+		KeepDefs:    *keepDefs,
+		Werror:      *werror,
+		Warnings:    os.Stderr,
+		MacrosFile:  *macroDefs,
+		Strict:      *strict,
+		NoHeader:    *noHeader,
+		Jobs:        *jobs,
+		Defines:     defines,
+		Invocations: *jsonFile != "",
+		TabWidth:    *tabWidth,
+		UseSpaces:   *useSpaces,
+
+		KeepPositions: *keepPos,
+		Trace:         *traceFile != "",
+		Stats:         *stats,
+		Annotate:      *annotate,
+	}
+	for _, out := range outs {
+		if out != "" {
+			opts.Outputs = append(opts.Outputs, out)
+		}
+	}
+	if *only != "" {
+		for _, name := range strings.Split(*only, ",") {
+			opts.Only = append(opts.Only, strings.TrimSpace(name))
+		}
+	}
+	if *verbose {
+		opts.Log = log.New(os.Stderr, "", 0)
+	}
+	results, err := ExpandFiles(ins, opts)
+	if err != nil {
+		printError(err)
+	}
+	for i, res := range results {
+		if *checkIdem {
+			if err := checkIdempotent(ins[i], res.Output, opts); err != nil {
+				printError(err)
+			}
+			continue
+		}
+		if *formatter != "" {
+			if res.Output, err = reformat(*formatter, ins[i], res.Output); err != nil {
+				fatal(err)
+			}
+		}
+		if err := writeResult(outs[i], res.Output); err != nil {
+			fatal(err)
+		}
+	}
+
+	if *jsonFile != "" {
+		if err := writeReport(*jsonFile, ins, outs, results); err != nil {
+			fatal(err)
+		}
+	}
+	if *traceFile != "" {
+		if err := writeTrace(*traceFile, ins, results); err != nil {
+			fatal(err)
+		}
+	}
+	if *stats {
+		printStats(results)
+	}
+
+	os.Exit(exitCode)
+}
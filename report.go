@@ -0,0 +1,139 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+)
+
+// An Invocation describes an expanded macro call.
+type Invocation struct {
+	Macro string         `json:"macro"` // name of the macro
+	Pos   token.Position `json:"pos"`   // position of the call
+	Args  []string       `json:"args"`  // source text of the arguments
+	Start int            `json:"start"` // byte offset of the expanded code in the output, or -1 if empty
+	End   int            `json:"end"`   // byte offset just past the expanded code, or -1 if empty
+}
+
+// An Expansion is a node of the tree of the expansions: a macro call,
+// with the calls expanded in its body nested under it.
+type Expansion struct {
+	Macro  string         // name of the macro
+	Pos    token.Position // position of the call
+	Args   []string       // source text of the arguments
+	Nested []*Expansion   // expansions of the macro calls in the body
+}
+
+// Stats summarizes the expansions of a template.
+type Stats struct {
+	Macros     int            `json:"macros"`     // number of the macros defined
+	Expansions int            `json:"expansions"` // number of the expanded macro calls
+	Counts     map[string]int `json:"counts"`     // number of the expansions of each macro
+	MaxDepth   int            `json:"max_depth"`  // deepest nesting of the expansions, 1 for the calls outside of the macros
+}
+
+// Add adds the expansions counted in t to s.
+func (s *Stats) Add(t *Stats) {
+	if t.Macros > s.Macros {
+		// The macros are shared by the templates.
+		s.Macros = t.Macros
+	}
+	s.Expansions += t.Expansions
+	if s.Counts == nil {
+		s.Counts = make(map[string]int)
+	}
+	for name, n := range t.Counts {
+		s.Counts[name] += n
+	}
+	if t.MaxDepth > s.MaxDepth {
+		s.MaxDepth = t.MaxDepth
+	}
+}
+
+// invocation records an expanded macro call
+// and the nodes it expanded into.
+type invocation struct {
+	call  *ast.CallExpr
+	name  string
+	args  []ast.Expr
+	nodes []ast.Node
+}
+
+// nodes returns the nodes of tree in depth-first order. Comments and
+// parentheses are left out, since the printer may move or drop them.
+func nodes(tree ast.Node) []ast.Node {
+	var list []ast.Node
+	ast.Inspect(tree, func(node ast.Node) bool {
+		switch node.(type) {
+		case nil, *ast.CommentGroup, *ast.Comment:
+			return false
+		case *ast.ParenExpr:
+			return true
+		}
+		list = append(list, node)
+		return true
+	})
+	return list
+}
+
+// locate returns the recorded invocations with the byte ranges of the
+// expanded code in output, the formatted tree. The transformed nodes
+// have no positions, so output is parsed again and its nodes are
+// matched with the ones of tree.
+func (v *visitor) locate(tree *ast.File, output []byte) []Invocation {
+	invocations := make([]Invocation, len(v.invocations))
+	for i, inv := range v.invocations {
+		args := make([]string, len(inv.args))
+		for j, arg := range inv.args {
+			args[j] = v.source(arg)
+		}
+		invocations[i] = Invocation{
+			Macro: inv.name,
+			Pos:   v.fset.Position(inv.call.Pos()),
+			Args:  args,
+			Start: -1,
+			End:   -1,
+		}
+	}
+
+	fset := token.NewFileSet()
+	parsed, err := parser.ParseFile(fset, "", output, 0)
+	if err != nil {
+		return invocations
+	}
+	before, after := nodes(tree), nodes(parsed)
+	if len(before) != len(after) {
+		return invocations
+	}
+	index := make(map[ast.Node]int, len(before))
+	for i, node := range before {
+		index[node] = i
+	}
+
+	for i, inv := range v.invocations {
+		if len(inv.nodes) == 0 {
+			continue
+		}
+		first, ok1 := index[inv.nodes[0]]
+		last, ok2 := index[inv.nodes[len(inv.nodes)-1]]
+		if !ok1 || !ok2 {
+			continue
+		}
+		invocations[i].Start = fset.Position(after[first].Pos()).Offset
+		invocations[i].End = fset.Position(after[last].End()).Offset
+	}
+	return invocations
+}
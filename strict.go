@@ -0,0 +1,253 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// siblings parses the other Go files of the package the templates
+// belong to, so that the names declared in them are known when the
+// expansion results are type-checked. The generated files and the
+// outputs of the templates, derived from their names if outputs is
+// empty, are left out: they may be stale expansion results.
+func siblings(fset *token.FileSet, templates, outputs []string, pkg string) []*ast.File {
+	skip := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, tmpl := range templates {
+		if len(outputs) == 0 {
+			skip[filepath.Clean(strings.TrimSuffix(tmpl, tmplExt))] = true
+		}
+		dirs[filepath.Dir(tmpl)] = true
+	}
+	for _, out := range outputs {
+		skip[filepath.Clean(out)] = true
+	}
+
+	var files []*ast.File
+	for dir := range dirs {
+		filenames, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+		for _, filename := range filenames {
+			if skip[filepath.Clean(filename)] || strings.HasSuffix(filename, "_test.go") {
+				continue
+			}
+			f, err := parser.ParseFile(fset, filename, nil, parser.ParseComments)
+			if err != nil || f.Name.Name != pkg || ast.IsGenerated(f) {
+				continue
+			}
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// checkUndefined type-checks the expansion results and reports the
+// identifiers left undefined by the expansion at their uses in the
+// bodies of the macros.
+func (v *visitor) checkUndefined(trees []*ast.File, results []*Result) {
+	fset := token.NewFileSet()
+	templates := make([]string, len(trees))
+	files := make([]*ast.File, len(trees))
+	expanded := make(map[string]bool)
+	for i, tree := range trees {
+		templates[i] = v.fset.Position(tree.Package).Filename
+		f, err := parser.ParseFile(fset, templates[i], results[i].Output, 0)
+		if err != nil {
+			v.errorf(tree.Package, "cannot parse the expansion result: %v", err)
+			return
+		}
+		files[i] = f
+		expanded[templates[i]] = true
+	}
+	pkg := files[0].Name.Name
+	files = append(files, siblings(fset, templates, v.opts.Outputs, pkg)...)
+
+	// Collect the undefined names.
+	undefined := make(map[string]bool)
+	conf := types.Config{
+		Importer: importer.Default(),
+		Error: func(err error) {
+			if err, ok := err.(types.Error); ok && expanded[fset.Position(err.Pos).Filename] {
+				if name := strings.TrimPrefix(err.Msg, "undefined: "); name != err.Msg {
+					undefined[name] = true
+				}
+			}
+		},
+	}
+	conf.Check(pkg, fset, files, nil)
+
+	// Point each undefined name back to the macros using it.
+	names := make([]string, 0, len(v.used))
+	for name := range v.used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		params := make(map[string]bool)
+		for _, param := range v.macroParams[name] {
+			params[param] = true
+		}
+		for _, output := range fieldNames(v.outputs[name]) {
+			params[output] = true
+		}
+		reported := make(map[string]bool)
+		var inspect func(node ast.Node) bool
+		inspect = func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.SelectorExpr:
+				// The selected names are not resolved in the scope.
+				ast.Inspect(node.X, inspect)
+				return false
+			case *ast.Ident:
+				if undefined[node.Name] && !params[node.Name] && !reported[node.Name] {
+					v.errorf(node.Pos(), "undefined: %s (in macro %q)", node.Name, name)
+					reported[node.Name] = true
+				}
+			}
+			return true
+		}
+		ast.Inspect(v.macros[name], inspect)
+	}
+}
+
+// checkArgs type-checks the templates and reports the macro calls
+// whose arguments are not assignable to the declared parameter types.
+// The macro definitions come from defs, declared in the files defsTrees.
+func (v *visitor) checkArgs(trees []*ast.File, defsTrees []*ast.File, defs []*ast.FuncDecl) {
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+	}
+	check := func(files []*ast.File) {
+		templates := make([]string, len(files))
+		for i, f := range files {
+			templates[i] = v.fset.Position(f.Package).Filename
+		}
+		pkg := files[0].Name.Name
+		conf := types.Config{
+			Importer: importer.Default(),
+			// The macro calls do not resolve, ignore the errors.
+			Error: func(error) {},
+		}
+		conf.Check(pkg, v.fset, append(files, siblings(v.fset, templates, v.opts.Outputs, pkg)...), info)
+	}
+	if len(defsTrees) > 0 && defsTrees[0].Name.Name != trees[0].Name.Name {
+		check(defsTrees)
+		check(trees)
+	} else {
+		check(append(defsTrees, trees...))
+	}
+
+	// Collect the declared types of the parameters.
+	paramTypes := make(map[string][]types.Type)
+	for _, def := range defs {
+		var params []types.Type
+		for _, field := range def.Type.Params.List {
+			for _, ident := range field.Names {
+				var typ types.Type
+				if obj := info.Defs[ident]; obj != nil {
+					typ = obj.Type()
+				}
+				params = append(params, typ)
+			}
+		}
+		paramTypes[macroName(def)] = params
+	}
+
+	for _, tree := range append(defsTrees, trees...) {
+		ast.Inspect(tree, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			name, args, ok := v.callee(call)
+			if !ok {
+				return true
+			}
+			params := paramTypes[name]
+			_, variadic := v.variadic[name]
+			for i, arg := range args {
+				if i == len(params) && !variadic {
+					break
+				}
+				param := params[len(params)-1]
+				if i < len(params)-1 || !variadic {
+					param = params[i]
+				} else if slice, ok := param.(*types.Slice); ok && !call.Ellipsis.IsValid() {
+					// One of the variadic arguments.
+					param = slice.Elem()
+				}
+				tv, ok := info.Types[arg]
+				if !ok || !tv.IsValue() || !isValid(tv.Type) || !isValid(param) {
+					continue
+				}
+				// The untyped constants must also be representable as param.
+				if !types.AssignableTo(tv.Type, param) || tv.Value != nil && !representable(tv.Value, param) {
+					v.errorf(call.Pos(), "cannot use %s (type %s) as %s value in argument %d to macro %q",
+						v.source(arg), tv.Type, param, i+1, name)
+				}
+			}
+			return true
+		})
+	}
+}
+
+// isValid reports whether typ is a known, valid type.
+func isValid(typ types.Type) bool {
+	return typ != nil && typ != types.Typ[types.Invalid]
+}
+
+// representable reports whether the constant val is representable
+// as a value of typ, if typ is a basic type.
+func representable(val constant.Value, typ types.Type) bool {
+	basic, ok := typ.Underlying().(*types.Basic)
+	if !ok {
+		return true
+	}
+	switch info := basic.Info(); {
+	case info&types.IsInteger != 0:
+		x := constant.ToInt(val)
+		if x.Kind() != constant.Int {
+			return false
+		}
+		bits := uint(64)
+		if sizes := types.SizesFor("gc", runtime.GOARCH); sizes != nil {
+			bits = uint(8 * sizes.Sizeof(basic))
+		}
+		if info&types.IsUnsigned != 0 {
+			return constant.Sign(x) >= 0 && constant.BitLen(x) <= int(bits)
+		}
+		min := constant.Shift(constant.MakeInt64(-1), token.SHL, bits-1)
+		max := constant.Shift(constant.MakeInt64(1), token.SHL, bits-1)
+		return constant.Compare(x, token.GEQ, min) && constant.Compare(x, token.LSS, max)
+	case info&types.IsFloat != 0:
+		return constant.ToFloat(val).Kind() == constant.Float
+	case info&types.IsComplex != 0:
+		return constant.ToComplex(val).Kind() == constant.Complex
+	case info&types.IsString != 0:
+		return val.Kind() == constant.String
+	case info&types.IsBoolean != 0:
+		return val.Kind() == constant.Bool
+	}
+	return true
+}